@@ -1,6 +1,23 @@
 package main
 
-import "fmt"
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
 
 // 备忘录模式是一种行为型设计模式。这种模式允许我们保存对象在某些关键节点时的必要信息，以便于在适当的时候可以将之恢复到之前的状态。通常它可以用来帮助设计撤销/恢复操作。
 
@@ -64,6 +81,625 @@ func (c *caretaker) getMemento(index int) *memento {
 	return c.mementoArray[index]
 }
 
+// 持久化管理人
+// 上面的 caretaker 只把备忘录放在内存里，进程退出后就全部丢失了。persistentCaretaker 先用编解码器（codec）把备忘录编码，
+// 再写进存储后端（storage）。写入的每个快照都带有校验和，恢复时校验不通过的快照会被拒绝，而不是被悄悄地应用到发起者上。
+
+var (
+	errSnapshotNotFound = errors.New("snapshot not found")
+	errCorruptSnapshot  = errors.New("snapshot is corrupted")
+)
+
+// 备忘录的可序列化形式，memento 的字段不导出，编解码时统一转换成它
+type snapshot struct {
+	State string
+}
+
+// 编解码器
+type codec interface {
+	encode(m *memento) ([]byte, error)
+	decode(data []byte) (*memento, error)
+}
+
+type jsonCodec struct {
+}
+
+func (c *jsonCodec) encode(m *memento) ([]byte, error) {
+	return json.Marshal(snapshot{State: m.state})
+}
+
+func (c *jsonCodec) decode(data []byte) (*memento, error) {
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &memento{state: s.State}, nil
+}
+
+type gobCodec struct {
+}
+
+func (c *gobCodec) encode(m *memento) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshot{State: m.state}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gobCodec) decode(data []byte) (*memento, error) {
+	var s snapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &memento{state: s.State}, nil
+}
+
+// 压缩层，可以包裹任意一个编解码器
+type gzipCodec struct {
+	inner codec
+}
+
+func (c *gzipCodec) encode(m *memento) ([]byte, error) {
+	data, err := c.inner.encode(m)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCodec) decode(data []byte) (*memento, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.inner.decode(raw)
+}
+
+// 存储后端
+type storage interface {
+	put(key string, data []byte) error
+	get(key string) ([]byte, error)
+	keys() ([]string, error)
+}
+
+// 内存存储
+type memoryStorage struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		data: make(map[string][]byte),
+	}
+}
+
+func (s *memoryStorage) put(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryStorage) get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.data[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errSnapshotNotFound, key)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *memoryStorage) keys() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// 磁盘目录存储，每个快照一个文件
+type dirStorage struct {
+	dir string
+}
+
+const snapshotExt = ".snap"
+
+func newDirStorage(dir string) (*dirStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &dirStorage{dir: dir}, nil
+}
+
+func (s *dirStorage) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid snapshot key %q", key)
+	}
+	return filepath.Join(s.dir, key+snapshotExt), nil
+}
+
+// 先写临时文件并落盘，再 rename 覆盖目标文件，保证读者要么看到旧快照，要么看到完整的新快照
+func (s *dirStorage) put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, "."+key+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *dirStorage) get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", errSnapshotNotFound, key)
+	}
+	return data, err
+}
+
+func (s *dirStorage) keys() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(name, snapshotExt))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// 快照帧格式：magic(4 字节) | sha256(32 字节) | 编码后的备忘录
+var snapshotMagic = []byte("MEM1")
+
+func seal(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	frame := make([]byte, 0, len(snapshotMagic)+len(sum)+len(payload))
+	frame = append(frame, snapshotMagic...)
+	frame = append(frame, sum[:]...)
+	return append(frame, payload...)
+}
+
+func unseal(frame []byte) ([]byte, error) {
+	header := len(snapshotMagic) + sha256.Size
+	if len(frame) < header || !bytes.Equal(frame[:len(snapshotMagic)], snapshotMagic) {
+		return nil, fmt.Errorf("%w: bad header", errCorruptSnapshot)
+	}
+	payload := frame[header:]
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:], frame[len(snapshotMagic):header]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptSnapshot)
+	}
+	return payload, nil
+}
+
+type persistentCaretaker struct {
+	codec   codec
+	storage storage
+}
+
+func newPersistentCaretaker(c codec, s storage) *persistentCaretaker {
+	return &persistentCaretaker{
+		codec:   c,
+		storage: s,
+	}
+}
+
+func (c *persistentCaretaker) saveMemento(key string, m *memento) error {
+	payload, err := c.codec.encode(m)
+	if err != nil {
+		return err
+	}
+	return c.storage.put(key, seal(payload))
+}
+
+func (c *persistentCaretaker) loadMemento(key string) (*memento, error) {
+	frame, err := c.storage.get(key)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := unseal(frame)
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %w", key, err)
+	}
+	return c.codec.decode(payload)
+}
+
+func (c *persistentCaretaker) listMementos() ([]string, error) {
+	return c.storage.keys()
+}
+
+func persistentDemo() error {
+	originator := &originator{state: "A"}
+	memCaretaker := newPersistentCaretaker(&gzipCodec{inner: &jsonCodec{}}, newMemoryStorage())
+	if err := memCaretaker.saveMemento("v1", originator.createMemento()); err != nil {
+		return err
+	}
+	originator.setState("B")
+	m, err := memCaretaker.loadMemento("v1")
+	if err != nil {
+		return err
+	}
+	originator.restoreMemento(m)
+	fmt.Printf("Restored from memory storage: %s\n", originator.getState())
+
+	dir, err := os.MkdirTemp("", "memento")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDirStorage(dir)
+	if err != nil {
+		return err
+	}
+	diskCaretaker := newPersistentCaretaker(&gobCodec{}, store)
+	for _, state := range []string{"C", "D"} {
+		originator.setState(state)
+		if err := diskCaretaker.saveMemento("v"+state, originator.createMemento()); err != nil {
+			return err
+		}
+	}
+	keys, err := diskCaretaker.listMementos()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Snapshots on disk: %v\n", keys)
+
+	// 模拟磁盘上的快照被损坏
+	path := filepath.Join(dir, "vC"+snapshotExt)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return err
+	}
+	if _, err := diskCaretaker.loadMemento("vC"); errors.Is(err, errCorruptSnapshot) {
+		fmt.Printf("Rejected snapshot: %v\n", err)
+	}
+	fmt.Printf("Originator Current State: %s\n", originator.getState())
+	return nil
+}
+
+// 增量备忘录
+// 对于很大的文档，每次 createMemento 都保留一份完整状态代价太高。deltaCaretaker 只保存与上一个快照之间的差异，
+// 每隔 interval 个增量再保存一次完整快照。恢复到任意一个点时，从它之前最近的完整快照开始依次重放增量。
+type deltaMemento struct {
+	full  bool
+	state string // full 为 true 时保存完整状态
+	// 增量：从 offset 开始删除 deleted 个字节，再插入 inserted
+	offset   int
+	deleted  int
+	inserted string
+}
+
+// 计算从 old 到 new 的增量，只保留公共前缀和公共后缀之间变化的部分
+func diffState(old, new string) *deltaMemento {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+	return &deltaMemento{
+		offset:  prefix,
+		deleted: len(old) - prefix - suffix,
+		// 拷贝一份，避免子串引用住整个新状态
+		inserted: strings.Clone(new[prefix : len(new)-suffix]),
+	}
+}
+
+func (d *deltaMemento) apply(state string) string {
+	return state[:d.offset] + d.inserted + state[d.offset+d.deleted:]
+}
+
+type deltaCaretaker struct {
+	interval  int
+	entries   []*deltaMemento
+	last      string // 最近一次快照对应的完整状态，用来计算下一个增量
+	sinceFull int
+}
+
+func newDeltaCaretaker(interval int) *deltaCaretaker {
+	if interval < 1 {
+		interval = 1
+	}
+	return &deltaCaretaker{
+		interval: interval,
+	}
+}
+
+func (c *deltaCaretaker) addMemento(m *memento) {
+	state := m.getSavedState()
+	if len(c.entries) == 0 || c.sinceFull >= c.interval {
+		c.entries = append(c.entries, &deltaMemento{full: true, state: state})
+		c.sinceFull = 0
+	} else {
+		c.entries = append(c.entries, diffState(c.last, state))
+		c.sinceFull++
+	}
+	c.last = state
+}
+
+func (c *deltaCaretaker) getMemento(index int) (*memento, error) {
+	if index < 0 || index >= len(c.entries) {
+		return nil, fmt.Errorf("memento index %d out of range [0, %d)", index, len(c.entries))
+	}
+	base := index
+	for !c.entries[base].full {
+		base--
+	}
+	state := c.entries[base].state
+	for _, d := range c.entries[base+1 : index+1] {
+		state = d.apply(state)
+	}
+	return &memento{state: state}, nil
+}
+
+// 模拟编辑一份大文档 edits 次，每次编辑后把快照交给 add
+func recordEdits(edits int, add func(*memento)) []string {
+	doc := []byte(strings.Repeat("lorem ipsum dolor sit amet ", 2500))
+	originator := &originator{state: string(doc)}
+	states := make([]string, 0, edits)
+	for i := 0; i < edits; i++ {
+		doc[(i*7919)%len(doc)] = byte('a' + i%26)
+		originator.setState(string(doc))
+		states = append(states, originator.getState())
+		add(originator.createMemento())
+	}
+	return states
+}
+
+// 构造一个 caretaker 并记录 edits 次编辑，返回 GC 之后它仍然占用的堆内存
+func retainedBytes(edits int, build func() func(*memento)) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	add := build()
+	recordEdits(edits, add)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(add)
+	if after.HeapAlloc < before.HeapAlloc {
+		return 0
+	}
+	return after.HeapAlloc - before.HeapAlloc
+}
+
+// 对比完整快照与增量快照的内存占用：GC 之后仍然保留的堆内存，以及记录一轮编辑的分配量
+func deltaDemo() error {
+	const edits = 200
+	delta := newDeltaCaretaker(50)
+	states := recordEdits(edits, delta.addMemento)
+	for i, want := range states {
+		m, err := delta.getMemento(i)
+		if err != nil {
+			return err
+		}
+		if m.getSavedState() != want {
+			return fmt.Errorf("delta memento %d restored wrong state", i)
+		}
+	}
+
+	newFull := func() func(*memento) { return (&caretaker{}).addMemento }
+	newDelta := func() func(*memento) { return newDeltaCaretaker(50).addMemento }
+	fmt.Printf("Retained heap after %d edits: full snapshots %d KB, delta snapshots %d KB\n",
+		edits, retainedBytes(edits, newFull)/1024, retainedBytes(edits, newDelta)/1024)
+
+	for _, c := range []struct {
+		name  string
+		build func() func(*memento)
+	}{{"full", newFull}, {"delta", newDelta}} {
+		// 每次编辑 originator 都会复制一份完整文档，两者的分配量都以此为主，差别在于之后能否被回收
+		result := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				recordEdits(edits, c.build())
+			}
+		})
+		fmt.Printf("%-5s %d edits: %d KB allocated, %d allocs per run\n",
+			c.name, edits, result.AllocedBytesPerOp()/1024, result.AllocsPerOp())
+	}
+	return nil
+}
+
+// 历史树
+// 线性的 mementoArray 在恢复到旧状态后再做修改时会丢掉原来的“未来”。historyTree 像 Vim 的 undo tree 一样，
+// 把每次恢复之后的新修改记录成一个新分支，旧的分支仍然可以切换回去。
+type historyNode struct {
+	id       int
+	parent   *historyNode
+	children []*historyNode
+	memento  *memento
+}
+
+type historyTree struct {
+	nodes   []*historyNode // 按 id 索引
+	current *historyNode
+}
+
+func newHistoryTree(m *memento) *historyTree {
+	root := &historyNode{id: 0, memento: m}
+	return &historyTree{
+		nodes:   []*historyNode{root},
+		current: root,
+	}
+}
+
+// 在当前节点下记录一个新状态，如果当前节点已经有子节点，就形成了一个新分支
+func (t *historyTree) addMemento(m *memento) int {
+	node := &historyNode{
+		id:      len(t.nodes),
+		parent:  t.current,
+		memento: m,
+	}
+	t.current.children = append(t.current.children, node)
+	t.nodes = append(t.nodes, node)
+	t.current = node
+	return node.id
+}
+
+func (t *historyTree) node(id int) (*historyNode, error) {
+	if id < 0 || id >= len(t.nodes) {
+		return nil, fmt.Errorf("history node %d not found", id)
+	}
+	return t.nodes[id], nil
+}
+
+// 跳转到任意节点，返回该节点的备忘录
+func (t *historyTree) restore(id int) (*memento, error) {
+	n, err := t.node(id)
+	if err != nil {
+		return nil, err
+	}
+	t.current = n
+	return n.memento, nil
+}
+
+// 撤销到父节点
+func (t *historyTree) undo() (*memento, error) {
+	if t.current.parent == nil {
+		return nil, fmt.Errorf("already at the oldest state")
+	}
+	return t.restore(t.current.parent.id)
+}
+
+// 所有分支，每个分支用它的叶子节点 id 表示，按创建顺序排列
+func (t *historyTree) branches() []int {
+	var leaves []int
+	for _, n := range t.nodes {
+		if len(n.children) == 0 {
+			leaves = append(leaves, n.id)
+		}
+	}
+	return leaves
+}
+
+// 切换到某个分支的末端，leaf 是 branches 返回的叶子节点 id
+func (t *historyTree) switchBranch(leaf int) (*memento, error) {
+	n, err := t.node(leaf)
+	if err != nil {
+		return nil, err
+	}
+	if len(n.children) != 0 {
+		return nil, fmt.Errorf("node %d is not the end of a branch", leaf)
+	}
+	return t.restore(leaf)
+}
+
+// 两个节点之间的差异
+type nodeDiff struct {
+	ancestor int           // 最近公共祖先
+	change   *deltaMemento // 从 a 的状态变到 b 的状态需要的修改
+}
+
+func (t *historyTree) diff(a, b int) (*nodeDiff, error) {
+	na, err := t.node(a)
+	if err != nil {
+		return nil, err
+	}
+	nb, err := t.node(b)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	for n := na; n != nil; n = n.parent {
+		seen[n.id] = true
+	}
+	ancestor := nb
+	for !seen[ancestor.id] {
+		ancestor = ancestor.parent
+	}
+	return &nodeDiff{
+		ancestor: ancestor.id,
+		change:   diffState(na.memento.getSavedState(), nb.memento.getSavedState()),
+	}, nil
+}
+
+func historyDemo() error {
+	originator := &originator{state: "A"}
+	history := newHistoryTree(originator.createMemento())
+	for _, state := range []string{"AB", "ABC"} {
+		originator.setState(state)
+		history.addMemento(originator.createMemento())
+	}
+
+	// 回到 1 号节点后做新的修改，原来的 ABC 成为另一个分支
+	m, err := history.restore(1)
+	if err != nil {
+		return err
+	}
+	originator.restoreMemento(m)
+	originator.setState("ABX")
+	history.addMemento(originator.createMemento())
+	branches := history.branches()
+	fmt.Printf("Branches: %v\n", branches)
+
+	m, err = history.switchBranch(branches[0])
+	if err != nil {
+		return err
+	}
+	originator.restoreMemento(m)
+	fmt.Printf("Switched to branch %d: %s\n", branches[0], originator.getState())
+	// 中间节点不是分支的末端
+	if _, err := history.switchBranch(1); err != nil {
+		fmt.Println(err)
+	}
+
+	d, err := history.diff(2, 3)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Diff 2 -> 3: common ancestor %d, replace %d bytes at %d with %q\n",
+		d.ancestor, d.change.deleted, d.change.offset, d.change.inserted)
+	return nil
+}
+
 func main() {
 	caretaker := &caretaker{
 		mementoArray: make([]*memento, 0),
@@ -87,4 +723,19 @@ func main() {
 
 	originator.restoreMemento(caretaker.getMemento(0))
 	fmt.Printf("Restored to State: %s\n", originator.getState())
+
+	fmt.Println()
+	if err := persistentDemo(); err != nil {
+		fmt.Println(err)
+	}
+
+	fmt.Println()
+	if err := deltaDemo(); err != nil {
+		fmt.Println(err)
+	}
+
+	fmt.Println()
+	if err := historyDemo(); err != nil {
+		fmt.Println(err)
+	}
 }
@@ -1,19 +1,110 @@
 package main
 
-import "fmt"
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // 抽象被观察者
 type Subject interface {
-	register(observer Observer)
+	register(observer Observer) *Subscription
 	deregister(observer Observer)
 	notifyAll()
 }
 
+// 事件，观察者不再只拿到商品名，而是拿到具体发生了什么变化
+type Event interface {
+	subject() string          // 发生变化的商品
+	withSeq(seq uint64) Event // 返回带上序号的事件
+}
+
+// 库存变化
+type StockChanged struct {
+	Item string
+	Old  bool
+	New  bool
+	Seq  uint64 `json:"-"` // 事件的序号，同一个事件重复投递时相同，写日志失败时为 0
+}
+
+func (e StockChanged) subject() string {
+	return e.Item
+}
+
+func (e StockChanged) withSeq(seq uint64) Event {
+	e.Seq = seq
+	return e
+}
+
+// 价格变化
+type PriceChanged struct {
+	Item string
+	Old  float64
+	New  float64
+	Seq  uint64 `json:"-"`
+}
+
+func (e PriceChanged) subject() string {
+	return e.Item
+}
+
+func (e PriceChanged) withSeq(seq uint64) Event {
+	e.Seq = seq
+	return e
+}
+
+// 订阅句柄，每次 register 都会得到一个新的句柄，即使观察者的 ID 相同
+type Subscription struct {
+	id        string
+	deliver   func(Event)
+	once      sync.Once
+	cancelled atomic.Bool
+	cancel    func()
+}
+
+// 取消订阅，可以重复调用，也可以在通知过程中（包括观察者自己的 update 里）调用
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.cancelled.Store(true)
+		if s.cancel != nil {
+			s.cancel()
+		}
+	})
+}
+
+func (s *Subscription) active() bool {
+	return !s.cancelled.Load()
+}
+
 // 具体被观察者
 type Item struct {
-	observerList []Observer
-	name         string
-	inStock      bool
+	mu            sync.Mutex
+	subscriptions []*Subscription // 按注册顺序排列，修改时整体替换，通知时遍历的是快照
+	name          string
+	inStock       bool
+	quantity      int
+	price         float64
+	dispatcher    *dispatcher // 不为空时异步通知观察者
+	log           *eventLog   // 不为空时先把事件写进持久化日志
+	durables      []*durableSubscriber
+	seq           uint64       // 没有日志时用来给事件编号
+	lastStock     StockChanged // 最近一次库存变化，notifyAll 重新通知的就是它
 }
 
 func newItem(name string) *Item {
@@ -21,55 +112,1495 @@ func newItem(name string) *Item {
 		name: name,
 	}
 }
+
+// 创建一个通过 dispatcher 异步通知观察者的商品
+func newAsyncItem(name string, d *dispatcher) *Item {
+	return &Item{
+		name:       name,
+		dispatcher: d,
+	}
+}
 func (i *Item) updateAvailability() {
 	fmt.Printf("Item %s is now in stock\n", i.name)
+	i.mu.Lock()
+	old := i.inStock
 	i.inStock = true
-	i.notifyAll()
+	i.mu.Unlock()
+	i.publish(StockChanged{Item: i.name, Old: old, New: true})
+}
+
+var errInsufficientStock = errors.New("insufficient stock")
+
+// 原子地增减库存，只有在有货和售罄之间切换时才通知观察者
+func (i *Item) adjustQuantity(delta int) error {
+	i.mu.Lock()
+	if i.quantity+delta < 0 {
+		i.mu.Unlock()
+		return fmt.Errorf("%w: %s has %d, want %d", errInsufficientStock, i.name, i.quantity, -delta)
+	}
+	old, new := i.setQuantityLocked(i.quantity + delta)
+	i.mu.Unlock()
+	i.publishTransition(old, new)
+	return nil
+}
+
+// 设置库存数量，返回设置前后是否有货。
+// updateAvailability 只标记有货而不改数量，所以以 inStock 为准，而不是用旧的数量推断
+func (i *Item) setQuantityLocked(quantity int) (old, new bool) {
+	old = i.inStock
+	i.quantity = quantity
+	i.inStock = quantity > 0
+	return old, i.inStock
+}
+
+// 只在有货状态变化时发布事件，返回事件的序号，没有发布时返回 0
+func (i *Item) publishTransition(old, new bool) uint64 {
+	if old == new {
+		return 0
+	}
+	return i.publish(StockChanged{Item: i.name, Old: old, New: new})
+}
+
+func (i *Item) getQuantity() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.quantity
+}
+
+func (i *Item) updatePrice(price float64) {
+	fmt.Printf("Item %s price changed to %.2f\n", i.name, price)
+	i.mu.Lock()
+	old := i.price
+	i.price = price
+	i.mu.Unlock()
+	i.publish(PriceChanged{Item: i.name, Old: old, New: price})
+}
+
+// 注册观察者，商品变为有货时它会收到通知
+func (i *Item) register(o Observer) *Subscription {
+	return i.addSubscription(o.getID(), func(e Event) {
+		// 只在从售罄变为有货时通知，重复的有货状态不算
+		if sc, ok := e.(StockChanged); ok && sc.New && !sc.Old {
+			o.update(sc)
+		}
+	})
 }
-func (i *Item) register(o Observer) {
-	i.observerList = append(i.observerList, o)
+
+// 订阅类型为 E 的事件，只有通过全部 filters 的事件才会交给 handler
+func subscribe[E Event](i *Item, id string, handler func(E), filters ...func(E) bool) *Subscription {
+	return i.addSubscription(id, func(e Event) {
+		typed, ok := e.(E)
+		if !ok {
+			return
+		}
+		for _, filter := range filters {
+			if !filter(typed) {
+				return
+			}
+		}
+		handler(typed)
+	})
 }
 
+// 价格从 threshold 以上降到 threshold 以下时才通知
+func priceDropsBelow(threshold float64) func(PriceChanged) bool {
+	return func(e PriceChanged) bool {
+		return e.Old >= threshold && e.New < threshold
+	}
+}
+
+func (i *Item) addSubscription(id string, deliver func(Event)) *Subscription {
+	sub := &Subscription{
+		id:      id,
+		deliver: deliver,
+	}
+	var unsubscribe func()
+	if i.dispatcher != nil {
+		var err error
+		if unsubscribe, err = i.dispatcher.subscribe(i.name, id, deliver); err != nil {
+			fmt.Printf("Register observer %s failed: %v\n", id, err)
+			sub.Unsubscribe()
+			return sub
+		}
+	}
+	sub.cancel = func() {
+		i.mu.Lock()
+		i.subscriptions = removeFromslice(i.subscriptions, sub)
+		i.mu.Unlock()
+		if unsubscribe != nil {
+			unsubscribe()
+		}
+	}
+	i.mu.Lock()
+	i.subscriptions = append(i.subscriptions[:len(i.subscriptions):len(i.subscriptions)], sub)
+	i.mu.Unlock()
+	return sub
+}
+
+// 取消该观察者 ID 的所有订阅
 func (i *Item) deregister(o Observer) {
-	i.observerList = removeFromslice(i.observerList, o)
+	i.mu.Lock()
+	var matched []*Subscription
+	for _, sub := range i.subscriptions {
+		if sub.id == o.getID() {
+			matched = append(matched, sub)
+		}
+	}
+	i.mu.Unlock()
+	for _, sub := range matched {
+		sub.Unsubscribe()
+	}
 }
 
+// 把最近一次库存变化重新通知给在线的观察者，事件的序号不变，所以按序号去重的通知渠道不会重复发送。
+// 事件已经在日志里了，不会再写一遍
 func (i *Item) notifyAll() {
-	for _, observer := range i.observerList {
-		observer.update(i.name)
+	i.mu.Lock()
+	last := i.lastStock
+	i.mu.Unlock()
+	if last.Item != "" {
+		i.deliver(last)
+	}
+}
+
+// 分配一个没有日志时使用的事件序号
+func (i *Item) nextSeqLocked() uint64 {
+	i.seq++
+	return i.seq
+}
+
+// 给事件分配序号并投递给观察者，返回分配的序号
+func (i *Item) publish(e Event) uint64 {
+	var seq uint64
+	if i.log != nil {
+		var err error
+		seq, err = i.log.append(e)
+		if err != nil {
+			fmt.Printf("Append event of item %s failed: %v\n", i.name, err)
+		}
+		e = e.withSeq(seq)
+		i.mu.Lock()
+		durables := i.durables
+		i.mu.Unlock()
+		for _, d := range durables {
+			i.catchUp(d)
+		}
+	} else {
+		i.mu.Lock()
+		seq = i.nextSeqLocked()
+		i.mu.Unlock()
+		e = e.withSeq(seq)
+	}
+	if sc, ok := e.(StockChanged); ok {
+		i.mu.Lock()
+		i.lastStock = sc
+		i.mu.Unlock()
 	}
+	i.deliver(e)
+	return seq
 }
 
-func removeFromslice(observerList []Observer, observerToRemove Observer) []Observer {
-	observerListLength := len(observerList)
-	for i, observer := range observerList {
-		if observerToRemove.getID() == observer.getID() {
-			observerList[observerListLength-1], observerList[i] = observerList[i], observerList[observerListLength-1]
-			return observerList[:observerListLength-1]
+// 把事件投递给在线的观察者
+func (i *Item) deliver(e Event) {
+	if i.dispatcher != nil {
+		if err := i.dispatcher.publish(e); err != nil {
+			fmt.Printf("Notify observers of item %s failed: %v\n", i.name, err)
+		}
+		return
+	}
+	i.mu.Lock()
+	subscriptions := i.subscriptions
+	i.mu.Unlock()
+	for _, sub := range subscriptions {
+		// 通知过程中被取消的订阅不再收到通知
+		if sub.active() {
+			sub.deliver(e)
 		}
 	}
-	return observerList
+}
+
+// 返回去掉 subToRemove 之后的新切片，保持其余订阅的顺序，不修改原切片，正在遍历旧切片的通知不受影响
+func removeFromslice(subscriptions []*Subscription, subToRemove *Subscription) []*Subscription {
+	for i, sub := range subscriptions {
+		if sub == subToRemove {
+			result := make([]*Subscription, 0, len(subscriptions)-1)
+			result = append(result, subscriptions[:i]...)
+			return append(result, subscriptions[i+1:]...)
+		}
+	}
+	return subscriptions
 }
 
 // 抽象观察者
 type Observer interface {
-	update(string)
+	update(e StockChanged)
 	getID() string
 }
 
 // 具体观察者
 type Customer struct {
-	id string
+	id       string
+	notifier Notifier // 为空时只打印
 }
 
-func (c *Customer) update(itemName string) {
-	fmt.Printf("Sending email to customer %s for item %s\n", c.id, itemName)
+func (c *Customer) update(e StockChanged) {
+	if c.notifier == nil {
+		fmt.Printf("Sending email to customer %s for item %s\n", c.id, e.Item)
+		return
+	}
+	n := Notification{
+		To:      c.id,
+		Subject: e.Item + " is back in stock",
+		Body:    fmt.Sprintf("Item %s is now in stock.", e.Item),
+	}
+	if e.Seq != 0 {
+		// 同一个事件被重复投递时（比如 notifyAll、持久化订阅的重新投递）键相同，只发一次；下一次补货是新的事件，照常通知
+		n.Key = fmt.Sprintf("restock|%s|%s|%d", c.id, e.Item, e.Seq)
+	}
+	if err := c.notifier.Notify(context.Background(), n); err != nil {
+		fmt.Printf("Notify customer %s for item %s failed: %v\n", c.id, e.Item, err)
+	}
 }
 
 func (c *Customer) getID() string {
 	return c.id
 }
 
+// 异步事件分发器
+// notifyAll 在调用方的 goroutine 里依次调用每个观察者，一个慢的观察者（比如发邮件）会拖住后面所有观察者。
+// dispatcher 给每个订阅者分配一个带缓冲的队列和一个独立的 goroutine，队列满时按 overflowPolicy 处理，
+// 某个订阅者 panic 只会影响它自己，Close 会等待所有队列里的通知投递完毕。
+
+var errDispatcherClosed = errors.New("dispatcher is closed")
+
+// 队列满时的处理策略
+type overflowPolicy int
+
+const (
+	overflowBlock      overflowPolicy = iota // 阻塞发布者直到队列有空位
+	overflowDropOldest                       // 丢弃队列里最旧的通知
+	overflowDropNewest                       // 丢弃当前这条新通知
+)
+
+type subscriberQueue struct {
+	subject string // 订阅的商品，同一个分发器可以被多个商品共用
+	id      string
+	deliver func(Event)
+	queue   chan Event
+	done    chan struct{} // 取消订阅时关闭，之后不再投递任何通知
+	stop    sync.Once
+	mu      sync.Mutex // 保证 drop-oldest 时“取出旧的、放入新的”是一个整体
+	dropped int
+}
+
+func (s *subscriberQueue) cancelled() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type dispatcher struct {
+	mu          sync.RWMutex
+	subscribers []*subscriberQueue
+	queueSize   int
+	policy      overflowPolicy
+	closed      bool
+	publishing  sync.WaitGroup // 正在向队列发送的 publish，Close 等它们结束后才关闭队列
+	wg          sync.WaitGroup
+}
+
+func newDispatcher(queueSize int, policy overflowPolicy) *dispatcher {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	return &dispatcher{
+		queueSize: queueSize,
+		policy:    policy,
+	}
+}
+
+// 订阅商品 subject 的事件，返回取消订阅的函数
+func (d *dispatcher) subscribe(subject, id string, deliver func(Event)) (func(), error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, errDispatcherClosed
+	}
+	s := &subscriberQueue{
+		subject: subject,
+		id:      id,
+		deliver: deliver,
+		queue:   make(chan Event, d.queueSize),
+		done:    make(chan struct{}),
+	}
+	d.subscribers = append(d.subscribers, s)
+	d.wg.Add(1)
+	go d.run(s)
+	return func() { d.unsubscribe(s) }, nil
+}
+
+// 取消订阅，还在队列里的通知会被丢弃。
+// 关闭 done 会唤醒阻塞在这个队列上的发布者并让订阅者的 goroutine 退出，队列本身不关闭，
+// 发布者拿的是订阅者列表的副本，可能还会往里发送
+func (d *dispatcher) unsubscribe(s *subscriberQueue) {
+	s.stop.Do(func() { close(s.done) })
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, sub := range d.subscribers {
+		if sub == s {
+			d.subscribers = append(d.subscribers[:i:i], d.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *dispatcher) publish(e Event) error {
+	// 只在读锁内复制订阅者列表，向队列发送可能阻塞，放在锁外进行，
+	// 否则阻塞期间某个观察者在 update 里取消订阅（需要写锁）就会死锁
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		return errDispatcherClosed
+	}
+	subscribers := d.subscribers
+	d.publishing.Add(1)
+	d.mu.RUnlock()
+	defer d.publishing.Done()
+	for _, s := range subscribers {
+		// 只投递给订阅了这个商品的订阅者
+		if s.subject == e.subject() {
+			d.enqueue(s, e)
+		}
+	}
+	return nil
+}
+
+func (d *dispatcher) enqueue(s *subscriberQueue, e Event) {
+	switch d.policy {
+	case overflowDropNewest:
+		select {
+		case s.queue <- e:
+		default:
+			s.mu.Lock()
+			s.dropped++
+			s.mu.Unlock()
+		}
+	case overflowDropOldest:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for {
+			select {
+			case s.queue <- e:
+				return
+			case <-s.done:
+				return
+			default:
+			}
+			select {
+			case <-s.queue:
+				s.dropped++
+			default:
+			}
+		}
+	default:
+		select {
+		case s.queue <- e:
+		case <-s.done:
+		}
+	}
+}
+
+// 队列被 Close 关闭或者订阅被取消时退出
+func (d *dispatcher) run(s *subscriberQueue) {
+	defer d.wg.Done()
+	for {
+		select {
+		case e, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			if !s.cancelled() {
+				d.deliver(s, e)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// 隔离订阅者的 panic，不影响它后续的通知以及其他订阅者
+func (d *dispatcher) deliver(s *subscriberQueue, e Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Observer %s panicked: %v\n", s.id, r)
+		}
+	}()
+	s.deliver(e)
+}
+
+// 关闭分发器，等待所有已排队的通知投递完毕
+func (d *dispatcher) Close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	subscribers := d.subscribers
+	d.subscribers = nil
+	d.mu.Unlock()
+	// 之后不会再有新的 publish，等已经开始的发送结束再关闭队列
+	d.publishing.Wait()
+	for _, s := range subscribers {
+		close(s.queue)
+	}
+	d.wg.Wait()
+}
+
+// 发邮件很慢的观察者
+type slowCustomer struct {
+	Customer
+	delay time.Duration
+}
+
+func (c *slowCustomer) update(e StockChanged) {
+	time.Sleep(c.delay)
+	c.Customer.update(e)
+}
+
+// 通知渠道
+// Customer.update 原来只打印一句 "Sending email"。Notifier 把真正的投递抽象出来，SMTP、HTTP webhook、文件/标准输出都是它的实现，
+// 重试和去重也做成 Notifier，可以像装饰器一样叠加在任意渠道外面。
+
+type Notification struct {
+	Key     string // 去重键，同一个键在去重窗口内只投递一次，为空时不去重
+	To      string
+	Subject string
+	Body    string
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// 不可重试的错误，比如收件人地址不合法、webhook 返回 4xx
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// 通过 SMTP 发邮件
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth // 可以为空
+	// ctx 没有截止时间时单次发送的超时，为 0 时用 30 秒
+	timeout time.Duration
+}
+
+func (s *smtpNotifier) Notify(ctx context.Context, n Notification) error {
+	if strings.ContainsAny(n.To, "\r\n") {
+		return &permanentError{err: fmt.Errorf("invalid recipient %q", n.To)}
+	}
+	// 主题里的换行会被当成新的邮件头，替换成空格
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Subject)
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", s.from, n.To, subject, n.Body)
+	if err := s.send(ctx, n.To, []byte(msg)); err != nil {
+		// ctx 到期或被取消导致的连接错误，统一报告成 ctx 的错误
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// smtp.SendMail 不接受 ctx，也没有超时，这里自己拨号并驱动 smtp.Client
+func (s *smtpNotifier) send(ctx context.Context, to string, msg []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// ctx 没有截止时间时用默认超时，服务器卡住也不会一直阻塞
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		timeout := s.timeout
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		deadline = time.Now().Add(timeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// ctx 被取消时关掉连接，打断正在进行的读写
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return &permanentError{err: err}
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	// 和 smtp.SendMail 一样，服务器支持时先升级到 TLS 再认证
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return &permanentError{err: errors.New("smtp: server doesn't support AUTH")}
+		}
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// 以 JSON 的形式 POST 到 webhook
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return &permanentError{err: err}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := w.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	case resp.StatusCode >= 300:
+		return &permanentError{err: fmt.Errorf("webhook returned %s", resp.Status)}
+	}
+	return nil
+}
+
+// 写到文件或标准输出
+type writerNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newStdoutNotifier() *writerNotifier {
+	return &writerNotifier{w: os.Stdout}
+}
+
+func (w *writerNotifier) Notify(ctx context.Context, n Notification) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := fmt.Fprintf(w.w, "To: %s | %s | %s\n", n.To, n.Subject, n.Body)
+	return err
+}
+
+// 失败后按指数退避重试
+type retryNotifier struct {
+	next      Notifier
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+func (r *retryNotifier) Notify(ctx context.Context, n Notification) error {
+	delay := r.baseDelay
+	for attempt := 1; ; attempt++ {
+		err := r.next.Notify(ctx, n)
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= r.attempts {
+			return fmt.Errorf("after %d attempts: %w", attempt, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay *= 2; r.maxDelay > 0 && delay > r.maxDelay {
+			delay = r.maxDelay
+		}
+	}
+}
+
+// 去重，同一个 Key 在 window 内只投递成功一次
+type dedupNotifier struct {
+	next   Notifier
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	sent      map[string]time.Time
+	inflight  map[string]chan struct{} // 正在发送的键，发送结束时关闭
+	lastPrune time.Time
+}
+
+func newDedupNotifier(next Notifier, window time.Duration) *dedupNotifier {
+	return &dedupNotifier{
+		next:     next,
+		window:   window,
+		now:      time.Now,
+		sent:     make(map[string]time.Time),
+		inflight: make(map[string]chan struct{}),
+	}
+}
+
+func (d *dedupNotifier) Notify(ctx context.Context, n Notification) error {
+	if n.Key == "" {
+		return d.next.Notify(ctx, n)
+	}
+	d.mu.Lock()
+	for {
+		if at, ok := d.sent[n.Key]; ok && d.now().Sub(at) < d.window {
+			d.mu.Unlock()
+			return nil
+		}
+		done, ok := d.inflight[n.Key]
+		if !ok {
+			break
+		}
+		// 同一个键正在发送，等它的结果：成功了就不用再发，失败了由这一次重新发送，避免通知丢失
+		d.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		d.mu.Lock()
+	}
+	done := make(chan struct{})
+	d.inflight[n.Key] = done
+	d.mu.Unlock()
+
+	err := d.next.Notify(ctx, n)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inflight, n.Key)
+	close(done)
+	if err == nil {
+		now := d.now()
+		d.pruneLocked(now)
+		d.sent[n.Key] = now
+	}
+	return err
+}
+
+// 调用方持有 d.mu。每个键只需要记住 window 这么久，每隔一个 window 清理一次，
+// 否则长期运行时每个顾客、商品和事件都会留下一条记录
+func (d *dedupNotifier) pruneLocked(now time.Time) {
+	if now.Sub(d.lastPrune) < d.window {
+		return
+	}
+	d.lastPrune = now
+	for key, at := range d.sent {
+		if now.Sub(at) >= d.window {
+			delete(d.sent, key)
+		}
+	}
+}
+
+// 测试替身：记录所有通知，前 failures 次调用返回错误
+type recordingNotifier struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	received []Notification
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.calls <= r.failures {
+		return fmt.Errorf("temporary failure %d", r.calls)
+	}
+	r.received = append(r.received, n)
+	return nil
+}
+
+// 测试替身：监听在本机的假 SMTP 服务器，只实现发信需要的最少命令，收到的邮件保存在内存里
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+type fakeSMTPServer struct {
+	ln       net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+func newFakeSMTPServer() (*fakeSMTPServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeSMTPServer{ln: ln}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *fakeSMTPServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeSMTPServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(textproto.NewConn(conn))
+		}()
+	}
+}
+
+func (s *fakeSMTPServer) handle(c *textproto.Conn) {
+	var msg smtpMessage
+	c.PrintfLine("220 localhost fake SMTP ready")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = smtpMessage{from: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			lines, err := c.ReadDotLines()
+			if err != nil {
+				return
+			}
+			msg.data = strings.Join(lines, "\n")
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "RSET", "NOOP":
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+func (s *fakeSMTPServer) close() {
+	s.ln.Close()
+	s.wg.Wait()
+}
+
+func notifierDemo() error {
+	server, err := newFakeSMTPServer()
+	if err != nil {
+		return err
+	}
+	defer server.close()
+	email := newDedupNotifier(&retryNotifier{
+		next:      &smtpNotifier{addr: server.addr(), from: "shop@example.com"},
+		attempts:  3,
+		baseDelay: 10 * time.Millisecond,
+	}, time.Hour)
+
+	var hits atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 第一次请求失败，验证重试
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hook.Close()
+	webhook := &retryNotifier{
+		next:      &webhookNotifier{url: hook.URL},
+		attempts:  3,
+		baseDelay: 10 * time.Millisecond,
+	}
+
+	recorder := &recordingNotifier{failures: 1}
+
+	item := newItem("Nike Sock")
+	item.register(&Customer{id: "recorder@gmail.com", notifier: &retryNotifier{next: recorder, attempts: 2}})
+	item.register(&Customer{id: "abc@gmail.com", notifier: email})
+	item.register(&Customer{id: "hook@gmail.com", notifier: webhook})
+	item.register(&Customer{id: "log@gmail.com", notifier: newStdoutNotifier()})
+	item.updateAvailability()
+	// 同一次补货再通知一遍，邮件不会重复发送
+	item.notifyAll()
+
+	fmt.Printf("Fake SMTP server received %d email(s), webhook was called %d time(s), recorder got %d of %d call(s)\n",
+		len(server.received()), hits.Load(), len(recorder.received), recorder.calls)
+
+	// 接受连接后一个字节都不回的服务器，发送会在 ctx 到期时返回
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer stalled.Close()
+	held := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := stalled.Accept(); err == nil {
+			held <- conn
+		}
+		close(held)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stalledSMTP := &smtpNotifier{addr: stalled.Addr().String(), from: "shop@example.com"}
+	err = stalledSMTP.Notify(ctx, Notification{To: "abc@gmail.com", Subject: "Nike Sock", Body: "back in stock"})
+	fmt.Printf("Stalled SMTP server: %v\n", err)
+	stalled.Close()
+	if conn := <-held; conn != nil {
+		conn.Close()
+	}
+	return nil
+}
+
+// 商品目录
+// 管理一组带数量的商品，以及每个商品的等待名单。补货时先按先来后到满足等待名单上的顾客，库存不够满足排在最前面的顾客时就停下，
+// 不会越过他去满足后面的人，剩下的库存才对外销售。
+var (
+	errUnknownItem  = errors.New("unknown item")
+	errInvalidCount = errors.New("invalid count")
+)
+
+type waiter struct {
+	observer Observer
+	want     int
+}
+
+type catalog struct {
+	mu        sync.Mutex
+	items     map[string]*Item
+	waitlists map[string][]*waiter
+}
+
+func newCatalog() *catalog {
+	return &catalog{
+		items:     make(map[string]*Item),
+		waitlists: make(map[string][]*waiter),
+	}
+}
+
+func (c *catalog) addItem(name string) *Item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if item, ok := c.items[name]; ok {
+		return item
+	}
+	item := newItem(name)
+	c.items[name] = item
+	return item
+}
+
+func (c *catalog) item(name string) (*Item, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownItem, name)
+	}
+	return item, nil
+}
+
+func (c *catalog) sell(name string, count int) error {
+	if count <= 0 {
+		return fmt.Errorf("%w: sell %d of %s", errInvalidCount, count, name)
+	}
+	item, err := c.item(name)
+	if err != nil {
+		return err
+	}
+	return item.adjustQuantity(-count)
+}
+
+// 加入等待名单，下次补货时按加入顺序为其预留 want 件
+func (c *catalog) joinWaitlist(name string, o Observer, want int) error {
+	if want <= 0 {
+		return fmt.Errorf("%w: want %d of %s", errInvalidCount, want, name)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[name]; !ok {
+		return fmt.Errorf("%w: %s", errUnknownItem, name)
+	}
+	c.waitlists[name] = append(c.waitlists[name], &waiter{observer: o, want: want})
+	return nil
+}
+
+func (c *catalog) restock(name string, count int) error {
+	if count < 0 {
+		return fmt.Errorf("%w: restock %d of %s", errInvalidCount, count, name)
+	}
+	c.mu.Lock()
+	item, ok := c.items[name]
+	if !ok {
+		c.mu.Unlock()
+		return fmt.Errorf("%w: %s", errUnknownItem, name)
+	}
+	waiters := c.waitlists[name]
+	item.mu.Lock()
+	available := item.quantity + count
+	var served []*waiter
+	for len(waiters) > 0 && waiters[0].want <= available {
+		available -= waiters[0].want
+		served = append(served, waiters[0])
+		waiters = waiters[1:]
+	}
+	old, new := item.setQuantityLocked(available)
+	item.mu.Unlock()
+	c.waitlists[name] = waiters
+	c.mu.Unlock()
+
+	// 等待名单上的顾客拿到的是为他预留的库存，商品本身可能仍然售罄，所以不依赖库存变化事件。
+	// 有库存变化事件时沿用它的序号，同时在等待名单上又注册了到货通知的顾客只会收到一封邮件
+	seq := item.publishTransition(old, new)
+	if seq == 0 && len(served) > 0 {
+		item.mu.Lock()
+		seq = item.nextSeqLocked()
+		item.mu.Unlock()
+	}
+	for _, w := range served {
+		w.observer.update(StockChanged{Item: name, Old: false, New: true, Seq: seq})
+	}
+	return nil
+}
+
+func catalogDemo() error {
+	c := newCatalog()
+	shoe := c.addItem("Nike Shoe")
+	shoe.register(&Customer{id: "watcher@gmail.com"})
+	subscribe(shoe, "ops@gmail.com", func(e StockChanged) {
+		fmt.Printf("Ops: %s in stock %t -> %t\n", e.Item, e.Old, e.New)
+	})
+
+	if err := c.restock("Nike Shoe", 2); err != nil {
+		return err
+	}
+	// 卖出一件不会触发通知，卖完才会
+	for n := 0; n < 2; n++ {
+		if err := c.sell("Nike Shoe", 1); err != nil {
+			return err
+		}
+	}
+	if err := c.sell("Nike Shoe", 1); err != nil {
+		fmt.Println(err)
+	}
+
+	for _, id := range []string{"first@gmail.com", "second@gmail.com", "third@gmail.com"} {
+		if err := c.joinWaitlist("Nike Shoe", &Customer{id: id}, 1); err != nil {
+			return err
+		}
+	}
+	// 只到了两件，按顺序通知前两位顾客，库存全部被预留，商品仍然是售罄状态
+	if err := c.restock("Nike Shoe", 2); err != nil {
+		return err
+	}
+	fmt.Printf("Nike Shoe quantity: %d\n", shoe.getQuantity())
+
+	// 负数的补货和不要任何商品的等待都会被拒绝
+	fmt.Println(c.restock("Nike Shoe", -1))
+	fmt.Println(c.joinWaitlist("Nike Shoe", &Customer{id: "nobody@gmail.com"}, 0))
+
+	// 先被标记为有货的商品，补货时不会再通知一次
+	boot := c.addItem("Nike Boot")
+	boot.register(&Customer{id: "boot@gmail.com"})
+	boot.updateAvailability()
+	if err := c.restock("Nike Boot", 3); err != nil {
+		return err
+	}
+
+	// 既注册了到货通知又在等待名单上的顾客，同一次补货只收到一封邮件
+	recorder := &recordingNotifier{}
+	both := &Customer{id: "both@gmail.com", notifier: newDedupNotifier(recorder, time.Hour)}
+	flipFlop := c.addItem("Nike Flip-Flop")
+	flipFlop.register(both)
+	if err := c.joinWaitlist("Nike Flip-Flop", both, 1); err != nil {
+		return err
+	}
+	if err := c.restock("Nike Flip-Flop", 2); err != nil {
+		return err
+	}
+	fmt.Printf("both@gmail.com got %d email(s)\n", len(recorder.received))
+	return nil
+}
+
+// 持久化事件日志
+// 商品可以把每个事件追加到一个带序号的日志文件里。持久化订阅者记录自己最后确认（ack）的序号，
+// 重启后从这个序号之后继续读取，错过的事件会被补发。处理成功后才确认，所以是至少一次（at-least-once）投递。
+
+type logRecord struct {
+	Seq  uint64          `json:"seq"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+var eventDecoders = map[string]func(json.RawMessage) (Event, error){
+	"StockChanged": decodeEvent[StockChanged],
+	"PriceChanged": decodeEvent[PriceChanged],
+}
+
+func decodeEvent[E Event](data json.RawMessage) (Event, error) {
+	var e E
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func eventType(e Event) (string, error) {
+	switch e.(type) {
+	case StockChanged:
+		return "StockChanged", nil
+	case PriceChanged:
+		return "PriceChanged", nil
+	}
+	return "", fmt.Errorf("unsupported event type %T", e)
+}
+
+// 每行一条 JSON 记录，追加写入后立即落盘
+type eventLog struct {
+	mu        sync.Mutex
+	f         *os.File
+	positions []int64 // 序号为 n 的记录从 positions[n-1] 处开始
+	size      int64
+}
+
+func openEventLog(path string) (*eventLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l := &eventLog{f: f}
+	for len(data[l.size:]) > 0 {
+		line, _, found := bytes.Cut(data[l.size:], []byte("\n"))
+		if !found {
+			// 最后一条记录没写完（没有换行）就崩溃了，截掉它
+			break
+		}
+		// 带换行的记录已经完整写入过，解析不了或者序号不连续说明日志损坏了，不能悄悄丢掉后面的事件
+		var r logRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("event log %s corrupted at offset %d: %w", path, l.size, err)
+		}
+		if want := uint64(len(l.positions)) + 1; r.Seq != want {
+			f.Close()
+			return nil, fmt.Errorf("event log %s corrupted at offset %d: got seq %d, want %d", path, l.size, r.Seq, want)
+		}
+		l.positions = append(l.positions, l.size)
+		l.size += int64(len(line)) + 1
+	}
+	if err := f.Truncate(l.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *eventLog) append(e Event) (uint64, error) {
+	typ, err := eventType(e)
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seq := uint64(len(l.positions)) + 1
+	line, err := json.Marshal(logRecord{Seq: seq, Type: typ, Data: data})
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+	if _, err := l.f.WriteAt(line, l.size); err != nil {
+		return 0, err
+	}
+	if err := l.f.Sync(); err != nil {
+		return 0, err
+	}
+	l.positions = append(l.positions, l.size)
+	l.size += int64(len(line))
+	return seq, nil
+}
+
+// 依次读取序号大于 after 的事件，fn 返回错误时停止
+func (l *eventLog) read(after uint64, fn func(seq uint64, e Event) error) error {
+	l.mu.Lock()
+	positions := l.positions
+	size := l.size
+	l.mu.Unlock()
+	for seq := after + 1; seq <= uint64(len(positions)); seq++ {
+		end := size
+		if seq < uint64(len(positions)) {
+			end = positions[seq]
+		}
+		buf := make([]byte, end-positions[seq-1])
+		if _, err := l.f.ReadAt(buf, positions[seq-1]); err != nil {
+			return err
+		}
+		var r logRecord
+		if err := json.Unmarshal(buf, &r); err != nil {
+			return fmt.Errorf("decode event %d: %w", seq, err)
+		}
+		decode, ok := eventDecoders[r.Type]
+		if !ok {
+			return fmt.Errorf("event %d has unknown type %q", seq, r.Type)
+		}
+		e, err := decode(r.Data)
+		if err != nil {
+			return fmt.Errorf("decode event %d: %w", seq, err)
+		}
+		if err := fn(seq, e.withSeq(seq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *eventLog) close() error {
+	return l.f.Close()
+}
+
+// 持久化保存每个订阅者已确认的序号，一个订阅者一个文件
+type offsetStore struct {
+	dir string
+}
+
+func newOffsetStore(dir string) (*offsetStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &offsetStore{dir: dir}, nil
+}
+
+func (s *offsetStore) path(id string) (string, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid subscriber id %q", id)
+	}
+	return filepath.Join(s.dir, id+".offset"), nil
+}
+
+func (s *offsetStore) load(id string) (uint64, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	// 空文件或内容损坏时当成什么都没确认过，从头重新投递；投递本来就是至少一次，
+	// 多投几条总比订阅者永远起不来要好
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+	return seq, nil
+}
+
+// 先写临时文件并 fsync 再 rename，最后 fsync 目录，避免崩溃时留下空的或写了一半的序号
+func (s *offsetStore) save(id string, seq uint64) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, id+".offset.tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatUint(seq, 10)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type durableSubscriber struct {
+	id      string
+	offsets *offsetStore
+	handler func(seq uint64, e Event) error
+	mu      sync.Mutex
+	acked   uint64
+}
+
+// 创建一个把事件写进 log 的商品，价格和库存状态从日志里已有的事件恢复
+func newLoggedItem(name string, log *eventLog) (*Item, error) {
+	i := &Item{
+		name: name,
+		log:  log,
+	}
+	err := log.read(0, func(seq uint64, e Event) error {
+		switch e := e.(type) {
+		case PriceChanged:
+			if e.Item == name {
+				i.price = e.New
+			}
+		case StockChanged:
+			if e.Item == name {
+				i.inStock = e.New
+				i.lastStock = e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("restore item %s: %w", name, err)
+	}
+	return i, nil
+}
+
+// 持久化订阅：先补发上次确认之后的所有事件，之后每个新事件都会投递。handler 返回错误的事件不会被确认，下次会重新投递
+func (i *Item) subscribeDurable(id string, offsets *offsetStore, handler func(seq uint64, e Event) error) (*Subscription, error) {
+	if i.log == nil {
+		return nil, fmt.Errorf("item %s has no event log", i.name)
+	}
+	acked, err := offsets.load(id)
+	if err != nil {
+		return nil, err
+	}
+	d := &durableSubscriber{
+		id:      id,
+		offsets: offsets,
+		handler: handler,
+		acked:   acked,
+	}
+	i.mu.Lock()
+	i.durables = append(i.durables[:len(i.durables):len(i.durables)], d)
+	i.mu.Unlock()
+	i.catchUp(d)
+	sub := &Subscription{id: id}
+	sub.cancel = func() {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		for n, other := range i.durables {
+			if other == d {
+				i.durables = append(i.durables[:n:n], i.durables[n+1:]...)
+				return
+			}
+		}
+	}
+	return sub, nil
+}
+
+func (i *Item) catchUp(d *durableSubscriber) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := i.log.read(d.acked, func(seq uint64, e Event) error {
+		// 多个商品可以共用一个日志
+		if e.subject() == i.name {
+			if err := d.handler(seq, e); err != nil {
+				return err
+			}
+		}
+		d.acked = seq
+		return d.offsets.save(d.id, seq)
+	})
+	if err != nil {
+		fmt.Printf("Deliver events to %s stopped at %d: %v\n", d.id, d.acked, err)
+	}
+}
+
+func eventLogDemo() error {
+	dir, err := os.MkdirTemp("", "observer")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	offsets, err := newOffsetStore(filepath.Join(dir, "offsets"))
+	if err != nil {
+		return err
+	}
+	logPath := filepath.Join(dir, "events.log")
+	log, err := openEventLog(logPath)
+	if err != nil {
+		return err
+	}
+	item, err := newLoggedItem("Nike Cap", log)
+	if err != nil {
+		return err
+	}
+	// 订阅者还没注册时发生的事件
+	item.updatePrice(40)
+	item.updateAvailability()
+
+	failed := false
+	handler := func(seq uint64, e Event) error {
+		if !failed {
+			failed = true
+			return errors.New("mail server unavailable")
+		}
+		fmt.Printf("abc@gmail.com got event %d: %+v\n", seq, e)
+		return nil
+	}
+	if _, err := item.subscribeDurable("abc", offsets, handler); err != nil {
+		return err
+	}
+	// 第一次投递失败，没有确认，下一次事件到来时会重新投递
+	item.updatePrice(35)
+	log.close()
+
+	// 模拟重启：重新打开日志，订阅者从上次确认的位置继续
+	if log, err = openEventLog(logPath); err != nil {
+		return err
+	}
+	defer log.close()
+	if item, err = newLoggedItem("Nike Cap", log); err != nil {
+		return err
+	}
+	// 价格是从日志恢复的，所以这个事件的旧价格是 35
+	item.updatePrice(30)
+	_, err = item.subscribeDurable("abc", offsets, func(seq uint64, e Event) error {
+		fmt.Printf("abc@gmail.com resumed with event %d: %+v\n", seq, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 崩溃留下的空 offset 文件不会让订阅失败，而是从头重新投递
+	if err := os.WriteFile(filepath.Join(dir, "offsets", "late.offset"), nil, 0o644); err != nil {
+		return err
+	}
+	replayed := 0
+	_, err = item.subscribeDurable("late", offsets, func(seq uint64, e Event) error {
+		replayed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("late@gmail.com with an empty offset replayed %d event(s)\n", replayed)
+	return corruptLogDemo(dir)
+}
+
+// 只有最后一条没写完的记录会被截掉，中间的损坏会让打开失败
+func corruptLogDemo(dir string) error {
+	torn := filepath.Join(dir, "torn.log")
+	if err := os.WriteFile(torn, []byte(`{"seq":1,"type":"PriceChanged","data":{"Item":"Nike Cap","Old":0,"New":10}}`+"\n"+`{"seq":2,"ty`), 0o644); err != nil {
+		return err
+	}
+	log, err := openEventLog(torn)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Torn log kept %d event(s)\n", len(log.positions))
+	log.close()
+
+	corrupted := filepath.Join(dir, "corrupted.log")
+	if err := os.WriteFile(corrupted, []byte("garbage\n"+`{"seq":2,"type":"PriceChanged","data":{}}`+"\n"), 0o644); err != nil {
+		return err
+	}
+	if log, err = openEventLog(corrupted); err == nil {
+		log.close()
+		return errors.New("corrupted log was opened")
+	}
+	fmt.Println(err)
+	return nil
+}
+
 func main() {
 	shirtItem := newItem("Nike Shirt")
 
@@ -77,7 +1608,68 @@ func main() {
 	observerSecond := &Customer{id: "xyz@gmail.com"}
 
 	shirtItem.register(observerFirst)
-	shirtItem.register(observerSecond)
+	subscription := shirtItem.register(observerSecond)
+	shirtItem.register(&Customer{id: "efg@gmail.com"})
 
 	shirtItem.updateAvailability()
+
+	// 取消订阅可以重复调用，其余观察者的通知顺序保持不变
+	subscription.Unsubscribe()
+	subscription.Unsubscribe()
+	shirtItem.notifyAll()
+
+	fmt.Println()
+	d := newDispatcher(8, overflowDropOldest)
+	shoeItem := newAsyncItem("Nike Shoe", d)
+	shoeItem.register(&slowCustomer{Customer: Customer{id: "slow@gmail.com"}, delay: 100 * time.Millisecond})
+	shoeItem.register(&Customer{id: "fast@gmail.com"})
+	// 共用同一个分发器的另一个商品，它的订阅者不会收到 Nike Shoe 的通知
+	sandalItem := newAsyncItem("Nike Sandal", d)
+	sandalItem.register(&Customer{id: "sandal@gmail.com"})
+	shoeItem.updateAvailability()
+	sandalItem.updateAvailability()
+	d.Close()
+
+	// 队列只有一个位置且满了会阻塞发布者，观察者在处理通知时取消另一个订阅不会死锁
+	blocking := newDispatcher(1, overflowBlock)
+	bootItem := newAsyncItem("Nike Boot", blocking)
+	var later *Subscription
+	subscribe(bootItem, "first@gmail.com", func(e PriceChanged) {
+		time.Sleep(10 * time.Millisecond)
+		later.Unsubscribe()
+		fmt.Printf("first@gmail.com: %s costs %.2f\n", e.Item, e.New)
+	})
+	later = subscribe(bootItem, "later@gmail.com", func(e PriceChanged) {})
+	for _, price := range []float64{50, 45, 40} {
+		bootItem.updatePrice(price)
+	}
+	blocking.Close()
+
+	fmt.Println()
+	hatItem := newItem("Nike Hat")
+	hatItem.updatePrice(30)
+	subscribe(hatItem, "deal@gmail.com", func(e PriceChanged) {
+		fmt.Printf("Price of %s dropped from %.2f to %.2f\n", e.Item, e.Old, e.New)
+	}, priceDropsBelow(20))
+	subscribe(hatItem, "stock@gmail.com", func(e StockChanged) {
+		fmt.Printf("Stock of %s changed from %t to %t\n", e.Item, e.Old, e.New)
+	})
+	hatItem.updatePrice(25)
+	hatItem.updatePrice(18)
+	hatItem.updateAvailability()
+
+	fmt.Println()
+	if err := notifierDemo(); err != nil {
+		fmt.Println(err)
+	}
+
+	fmt.Println()
+	if err := catalogDemo(); err != nil {
+		fmt.Println(err)
+	}
+
+	fmt.Println()
+	if err := eventLogDemo(); err != nil {
+		fmt.Println(err)
+	}
 }
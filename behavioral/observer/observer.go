@@ -2,64 +2,112 @@ package main
 
 import "fmt"
 
+// 事件 观察者通过它知道主题发生了什么变化
+type Event interface {
+	Source() string // 发生变化的主题
+}
+
+// 主题的状态发生了变化
+type StateChanged struct {
+	Subject  string
+	Old, New string
+}
+
+func (e StateChanged) Source() string {
+	return e.Subject
+}
+
 // 主题 发布者
 type ISubject interface {
 	AddObservers(observers ...IObserver) // 添加观察者
-	NotifyObservers()                    // 通知观察者
+	NotifyObservers(e Event)             // 通知观察者
 }
 
 // 具体主题
 type Subject2 struct {
 	observers []IObserver
+	state     string
 }
 
 func (s *Subject2) AddObservers(observers ...IObserver) {
 	s.observers = append(s.observers, observers...)
 }
 
-func (s *Subject2) NotifyObservers() {
+func (s *Subject2) NotifyObservers(e Event) {
 	for k := range s.observers {
-		s.observers[k].Notify() // 触发观察者
+		s.observers[k].Notify(e) // 触发观察者
 	}
 }
 
+// 更改状态，并把新旧状态通知给观察者
+func (s *Subject2) SetState(state string) {
+	old := s.state
+	s.state = state
+	s.NotifyObservers(StateChanged{Subject: "Subject2", Old: old, New: state})
+}
+
 // 具体主题
 type Subject1 struct {
 	observers []IObserver
+	state     string
 }
 
 func (s *Subject1) AddObservers(observers ...IObserver) {
 	s.observers = append(s.observers, observers...)
 }
 
-func (s *Subject1) NotifyObservers() {
+func (s *Subject1) NotifyObservers(e Event) {
 	for k := range s.observers {
-		s.observers[k].Notify() // 触发观察者
+		s.observers[k].Notify(e) // 触发观察者
 	}
 }
 
+func (s *Subject1) SetState(state string) {
+	old := s.state
+	s.state = state
+	s.NotifyObservers(StateChanged{Subject: "Subject1", Old: old, New: state})
+}
+
 // 抽象观察者 订阅者
 type IObserver interface {
-	Notify() // 当被观察对象有更改的时候，出发观察者的Notify() 方法
+	Notify(e Event) // 当被观察对象有更改的时候，出发观察者的Notify() 方法，e 描述了发生的变化
 }
 
 // 具体订阅者
 type Observer2 struct {
 }
 
-func (o *Observer2) Notify() {
-	fmt.Println("已经触发了观察者2")
+func (o *Observer2) Notify(e Event) {
+	fmt.Printf("已经触发了观察者2: %+v\n", e)
 }
 
 // 具体订阅者
 type Observer1 struct {
 }
 
-func (o *Observer1) Notify() {
-	fmt.Println("已经触发了观察者1")
+func (o *Observer1) Notify(e Event) {
+	fmt.Printf("已经触发了观察者1: %+v\n", e)
+}
+
+// 只把满足 filter 的事件转交给内部的观察者
+type FilteredObserver struct {
+	IObserver
+	filter func(Event) bool
 }
 
+func (o *FilteredObserver) Notify(e Event) {
+	if o.filter(e) {
+		o.IObserver.Notify(e)
+	}
+}
 
+// 只关心变成 state 的状态变化
+func becomes(state string) func(Event) bool {
+	return func(e Event) bool {
+		sc, ok := e.(StateChanged)
+		return ok && sc.New == state
+	}
+}
 
 func main() {
 	// 创建主题
@@ -70,12 +118,13 @@ func main() {
 	o1 := new(Observer1)
 	// 为主题添加订阅者
 	s2.AddObservers(o2, o1)
-	s1.AddObservers(o1, o2)
+	s1.AddObservers(o1, &FilteredObserver{IObserver: o2, filter: becomes("done")})
 
 	// 这里的主题要做各种更改...
 
 	// 更改完毕，触发订阅者
-	s2.NotifyObservers() // output: 已经触发了订阅者
+	s2.SetState("done") // output: 已经触发了订阅者
 	fmt.Println()
-	s1.NotifyObservers()
+	s1.SetState("running")
+	s1.SetState("done")
 }
@@ -0,0 +1,1154 @@
+package main
+
+// 声明式有限状态机
+// state.go 和 vendingMachine.go 里每个状态都是一个结构体，每个事件一个方法，大部分方法只是返回“不允许”。
+// 这里把状态、事件、守卫条件和转换声明在一张表里，由 Machine 统一负责查表、执行守卫和动作、调用进入/退出钩子，
+// 表里没有声明的转换会被拒绝并返回 *TransitionError。Machine 对上下文类型 C 是泛型的，C 就是原来的“上下文角色”。
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StateID string
+type EventID string
+
+var (
+	ErrInvalidTransition = errors.New("invalid transition")
+	ErrGuardRejected     = errors.New("guard rejected transition")
+)
+
+// 转换被拒绝时返回的错误，可以用 errors.Is 判断是没有对应转换（ErrInvalidTransition）还是守卫不通过（ErrGuardRejected）
+type TransitionError struct {
+	State  StateID
+	Event  EventID
+	Reason error // 守卫返回的错误，没有对应转换时为空
+}
+
+func (e *TransitionError) Error() string {
+	if e.Reason == nil {
+		return fmt.Sprintf("event %s is not allowed in state %s", e.Event, e.State)
+	}
+	return fmt.Sprintf("event %s rejected in state %s: %v", e.Event, e.State, e.Reason)
+}
+
+func (e *TransitionError) Unwrap() []error {
+	if e.Reason == nil {
+		return []error{ErrInvalidTransition}
+	}
+	return []error{ErrGuardRejected, e.Reason}
+}
+
+// 转换表中的一行。同一个状态和事件可以有多行，按声明顺序取第一个守卫通过的
+type Transition[C any] struct {
+	From   StateID
+	Event  EventID
+	To     StateID                    // 为空表示内部转换：只执行动作，不离开当前状态，也不触发进入/退出钩子
+	Guard  func(ctx C, arg any) error // 为空表示总是允许
+	Action func(ctx C, arg any) error // 在离开旧状态之前执行，返回错误时状态保持不变
+	Label  string                     // 守卫条件的说明，导出状态图时标在边上
+}
+
+type Definition[C any] struct {
+	Initial     StateID
+	Transitions []Transition[C]
+	OnEnter     map[StateID]func(ctx C)
+	OnExit      map[StateID]func(ctx C)
+	// 子状态 -> 父状态。当前状态没有处理的事件交给父状态，子状态可以用自己的转换覆盖父状态的
+	Parents map[StateID]StateID
+	// 在某个状态停留一段时间后自动触发的事件
+	Timeouts []Timeout
+}
+
+type Timeout struct {
+	State StateID
+	After time.Duration
+	Event EventID
+}
+
+// 时钟，测试时可以换成手动推进的时钟
+type Clock interface {
+	AfterFunc(d time.Duration, f func()) (stop func())
+}
+
+type realClock struct {
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() {
+	t := time.AfterFunc(d, f)
+	return func() { t.Stop() }
+}
+
+// 手动推进的时钟，Advance 时在调用方的 goroutine 里依次触发到期的定时器
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Duration
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	at      time.Duration
+	f       func()
+	stopped bool
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{at: c.now + d, f: f}
+	c.timers = append(c.timers, t)
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		t.stopped = true
+	}
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now + d
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		var next *manualTimer
+		for _, t := range c.timers {
+			if !t.stopped && t.at <= target && (next == nil || t.at < next.at) {
+				next = t
+			}
+		}
+		if next == nil {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		next.stopped = true
+		c.now = next.at
+		c.mu.Unlock()
+		next.f()
+	}
+}
+
+type Machine[C any] struct {
+	mu      sync.Mutex
+	def     *Definition[C]
+	ctx     C
+	current StateID
+	table   map[StateID]map[EventID][]*Transition[C]
+	clock   Clock
+	timers  map[StateID]*func() // 处于激活状态的定时器，键是设置它的状态
+	// 定时器到期时用它触发事件，调用时持有 mu。Journal 把它换成先写日志再触发，这样超时事件也能重放
+	fireTimeout func(event EventID) error
+}
+
+func NewMachine[C any](def *Definition[C], ctx C) (*Machine[C], error) {
+	return NewMachineWithClock(def, ctx, realClock{})
+}
+
+func NewMachineWithClock[C any](def *Definition[C], ctx C, clock Clock) (*Machine[C], error) {
+	if def.Initial == "" {
+		return nil, errors.New("state machine has no initial state")
+	}
+	m, err := newMachine(def, ctx, clock, def.Initial, nil)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.start()
+	return m, nil
+}
+
+// 创建停在 start 状态的状态机，调用方持有 mu 调用 start 之后才真正进入这个状态。fireTimeout 为空时超时事件直接在状态机上触发
+func newMachine[C any](def *Definition[C], ctx C, clock Clock, start StateID, fireTimeout func(EventID) error) (*Machine[C], error) {
+	table := make(map[StateID]map[EventID][]*Transition[C])
+	for n := range def.Transitions {
+		t := &def.Transitions[n]
+		if t.From == "" || t.Event == "" {
+			return nil, fmt.Errorf("transition %d has no source state or event", n)
+		}
+		if table[t.From] == nil {
+			table[t.From] = make(map[EventID][]*Transition[C])
+		}
+		table[t.From][t.Event] = append(table[t.From][t.Event], t)
+	}
+	for s := range def.Parents {
+		seen := map[StateID]bool{}
+		for p := s; p != ""; p = def.Parents[p] {
+			if seen[p] {
+				return nil, fmt.Errorf("state %s has a cyclic parent chain", s)
+			}
+			seen[p] = true
+		}
+	}
+	m := &Machine[C]{
+		def:     def,
+		ctx:     ctx,
+		current: start,
+		table:   table,
+		clock:   clock,
+		timers:  make(map[StateID]*func()),
+	}
+	m.fireTimeout = fireTimeout
+	if m.fireTimeout == nil {
+		m.fireTimeout = func(event EventID) error { return m.fire(event, nil) }
+	}
+	return m, nil
+}
+
+// 进入当前状态及其祖先，执行进入钩子并启动定时器，调用时持有 mu
+func (m *Machine[C]) start() {
+	m.enter(m.ancestors(m.current), "")
+}
+
+func (m *Machine[C]) Current() StateID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current
+}
+
+func (m *Machine[C]) Context() C {
+	return m.ctx
+}
+
+// 从 s 开始沿父状态链向上，包括 s 自己
+func (m *Machine[C]) ancestors(s StateID) []StateID {
+	var chain []StateID
+	for ; s != ""; s = m.def.Parents[s] {
+		chain = append(chain, s)
+	}
+	return chain
+}
+
+// 触发事件，arg 会原样传给守卫和动作。当前状态没有对应转换时依次查找父状态
+func (m *Machine[C]) Fire(event EventID, arg any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fire(event, arg)
+}
+
+func (m *Machine[C]) fire(event EventID, arg any) error {
+	found := false
+	var rejected error
+	for _, s := range m.ancestors(m.current) {
+		for _, t := range m.table[s][event] {
+			found = true
+			if t.Guard != nil {
+				if err := t.Guard(m.ctx, arg); err != nil {
+					rejected = err
+					continue
+				}
+			}
+			return m.apply(t, arg)
+		}
+	}
+	if !found {
+		return &TransitionError{State: m.current, Event: event}
+	}
+	return &TransitionError{State: m.current, Event: event, Reason: rejected}
+}
+
+func (m *Machine[C]) apply(t *Transition[C], arg any) error {
+	if t.Action != nil {
+		if err := t.Action(m.ctx, arg); err != nil {
+			return err
+		}
+	}
+	if t.To == "" {
+		return nil
+	}
+	// 退出到源状态和目标状态的最近公共祖先为止，再从公共祖先一路进入目标状态；转换到自身时退出再重新进入
+	target := m.ancestors(t.To)
+	inTarget := make(map[StateID]bool, len(target))
+	for _, s := range target {
+		inTarget[s] = true
+	}
+	var common StateID
+	for _, s := range m.ancestors(m.current) {
+		if inTarget[s] && s != t.To {
+			common = s
+			break
+		}
+		if stop, ok := m.timers[s]; ok {
+			(*stop)()
+			delete(m.timers, s)
+		}
+		if exit := m.def.OnExit[s]; exit != nil {
+			exit(m.ctx)
+		}
+	}
+	m.current = t.To
+	m.enter(target, common)
+	return nil
+}
+
+// 按从外到内的顺序进入 path 中位于 common 之下的状态，path 是从最内层开始的祖先链
+func (m *Machine[C]) enter(path []StateID, common StateID) {
+	var entering []StateID
+	for _, s := range path {
+		if s == common {
+			break
+		}
+		entering = append(entering, s)
+	}
+	for n := len(entering) - 1; n >= 0; n-- {
+		s := entering[n]
+		if enter := m.def.OnEnter[s]; enter != nil {
+			enter(m.ctx)
+		}
+		for _, timeout := range m.def.Timeouts {
+			if timeout.State == s {
+				m.schedule(timeout)
+			}
+		}
+	}
+}
+
+func (m *Machine[C]) schedule(timeout Timeout) {
+	var stop func()
+	token := &stop
+	stop = m.clock.AfterFunc(timeout.After, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// 定时器到期之前已经离开了这个状态
+		if m.timers[timeout.State] != token {
+			return
+		}
+		delete(m.timers, timeout.State)
+		if err := m.fireTimeout(timeout.Event); err != nil {
+			fmt.Printf("Timeout event %s in state %s failed: %v\n", timeout.Event, m.current, err)
+		}
+	})
+	m.timers[timeout.State] = token
+}
+
+// 停止所有定时器，调用时持有 mu
+func (m *Machine[C]) stopTimersLocked() {
+	for s, stop := range m.timers {
+		(*stop)()
+		delete(m.timers, s)
+	}
+}
+
+// 状态图导出
+// 状态和转换都声明在表里，所以可以直接把状态机导出成 Graphviz DOT 或 Mermaid stateDiagram，守卫说明标在边上，当前状态高亮，
+// 评审设计时贴进文档的图永远和代码保持一致。
+
+// 按声明顺序列出所有状态，包括父状态
+func (d *Definition[C]) states() []StateID {
+	seen := map[StateID]bool{d.Initial: true}
+	states := []StateID{d.Initial}
+	add := func(s StateID) {
+		if s != "" && !seen[s] {
+			seen[s] = true
+			states = append(states, s)
+		}
+	}
+	for _, t := range d.Transitions {
+		add(t.From)
+		add(t.To)
+	}
+	for _, s := range append([]StateID(nil), states...) {
+		for p := d.Parents[s]; p != ""; p = d.Parents[p] {
+			add(p)
+		}
+	}
+	return states
+}
+
+// 直接子状态，按声明顺序排列
+func (d *Definition[C]) children(parent StateID) []StateID {
+	var children []StateID
+	for _, s := range d.states() {
+		if d.Parents[s] == parent && s != parent {
+			children = append(children, s)
+		}
+	}
+	return children
+}
+
+// 父状态在图里画成一个框，边只能连到框里的某个叶子状态上
+func (d *Definition[C]) firstLeaf(s StateID) StateID {
+	for children := d.children(s); len(children) > 0; children = d.children(s) {
+		s = children[0]
+	}
+	return s
+}
+
+func edgeLabel[C any](t *Transition[C]) string {
+	if t.Label == "" {
+		return string(t.Event)
+	}
+	return fmt.Sprintf("%s [%s]", t.Event, t.Label)
+}
+
+func (m *Machine[C]) DOT() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("digraph fsm {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  compound=true;\n")
+	b.WriteString("  node [shape=box, style=rounded];\n")
+	b.WriteString("  __start [shape=point];\n")
+	fmt.Fprintf(&b, "  __start -> %s;\n", strconv.Quote(string(m.def.firstLeaf(m.def.Initial))))
+	var writeState func(s StateID, indent string)
+	writeState = func(s StateID, indent string) {
+		if children := m.def.children(s); len(children) > 0 {
+			fmt.Fprintf(&b, "%ssubgraph %s {\n", indent, strconv.Quote("cluster_"+string(s)))
+			fmt.Fprintf(&b, "%s  label=%s;\n", indent, strconv.Quote(string(s)))
+			fmt.Fprintf(&b, "%s  style=rounded;\n", indent)
+			for _, c := range children {
+				writeState(c, indent+"  ")
+			}
+			fmt.Fprintf(&b, "%s}\n", indent)
+			return
+		}
+		if s == m.current {
+			fmt.Fprintf(&b, "%s%s [style=\"rounded,filled\", fillcolor=lightblue, penwidth=2];\n", indent, strconv.Quote(string(s)))
+		} else {
+			fmt.Fprintf(&b, "%s%s;\n", indent, strconv.Quote(string(s)))
+		}
+	}
+	for _, s := range m.def.states() {
+		if m.def.Parents[s] == "" {
+			writeState(s, "  ")
+		}
+	}
+	for n := range m.def.Transitions {
+		t := &m.def.Transitions[n]
+		from, to := m.def.firstLeaf(t.From), t.To
+		var attrs []string
+		if to == "" {
+			// 内部转换画成指向自己的虚线
+			to = t.From
+			attrs = append(attrs, "style=dashed")
+		} else if from != t.From && !slices.Contains(m.ancestors(t.To), t.From) {
+			// 目标在框内时 Graphviz 无法从框的边上出发
+			attrs = append(attrs, "ltail="+strconv.Quote("cluster_"+string(t.From)))
+		}
+		if leaf := m.def.firstLeaf(to); leaf != to {
+			if t.To != "" {
+				attrs = append(attrs, "lhead="+strconv.Quote("cluster_"+string(to)))
+			}
+			to = leaf
+		}
+		label := edgeLabel(t)
+		if from != t.From && t.To == "" {
+			label = fmt.Sprintf("%s: %s", t.From, label)
+		}
+		attrs = append([]string{"label=" + strconv.Quote(label)}, attrs...)
+		fmt.Fprintf(&b, "  %s -> %s [%s];\n", strconv.Quote(string(from)), strconv.Quote(string(to)), strings.Join(attrs, ", "))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (m *Machine[C]) Mermaid() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("stateDiagram-v2\n")
+	// 父状态画成复合状态
+	var writeComposite func(s StateID, indent string)
+	writeComposite = func(s StateID, indent string) {
+		children := m.def.children(s)
+		if len(children) == 0 {
+			fmt.Fprintf(&b, "%s%s\n", indent, s)
+			return
+		}
+		fmt.Fprintf(&b, "%sstate %s {\n", indent, s)
+		for _, c := range children {
+			writeComposite(c, indent+"    ")
+		}
+		fmt.Fprintf(&b, "%s}\n", indent)
+	}
+	for _, s := range m.def.states() {
+		if m.def.Parents[s] == "" && len(m.def.children(s)) > 0 {
+			writeComposite(s, "    ")
+		}
+	}
+	fmt.Fprintf(&b, "    [*] --> %s\n", m.def.Initial)
+	for n := range m.def.Transitions {
+		t := &m.def.Transitions[n]
+		to := t.To
+		if to == "" {
+			to = t.From
+		}
+		// Mermaid 的边标签里冒号有特殊含义
+		fmt.Fprintf(&b, "    %s --> %s: %s\n", t.From, to, strings.ReplaceAll(edgeLabel(t), ":", "#58;"))
+	}
+	b.WriteString("    classDef current fill:#add8e6,stroke-width:2px\n")
+	fmt.Fprintf(&b, "    class %s current\n", m.current)
+	return b.String()
+}
+
+// 事件溯源
+// Journal 把每一次成功的转换追加到日志文件，进程重启后从最近的快照开始重放日志，恢复当前状态和上下文。
+// 每 SnapshotEvery 条记录保存一次快照并清空日志，让恢复保持很快。重放时动作和钩子会再执行一遍，所以它们应该只修改上下文。
+
+const journalVersion = 1
+
+// 日志里出现了当前代码不认识的版本或事件
+type VersionError struct {
+	Seq     uint64
+	Version int
+	Event   EventID
+}
+
+func (e *VersionError) Error() string {
+	if e.Version != journalVersion {
+		return fmt.Sprintf("journal record %d has version %d, want %d", e.Seq, e.Version, journalVersion)
+	}
+	return fmt.Sprintf("journal record %d has unknown event %s", e.Seq, e.Event)
+}
+
+type journalRecord struct {
+	Version int             `json:"v"`
+	Seq     uint64          `json:"seq"`
+	Event   EventID         `json:"event"`
+	Arg     json.RawMessage `json:"arg,omitempty"`
+}
+
+type machineSnapshot struct {
+	Version int             `json:"v"`
+	Seq     uint64          `json:"seq"`
+	State   StateID         `json:"state"`
+	Context json.RawMessage `json:"context"`
+}
+
+type JournalOptions struct {
+	SnapshotEvery int
+	Clock         Clock // 为空时使用真实时钟
+	// 事件参数的解码函数，参数为空的事件不需要登记
+	Args map[EventID]func(json.RawMessage) (any, error)
+}
+
+// 解码 int 类型的事件参数
+func intArg(data json.RawMessage) (any, error) {
+	var n int
+	err := json.Unmarshal(data, &n)
+	return n, err
+}
+
+type Journal[C any] struct {
+	machine *Machine[C]
+	dir     string
+	opts    JournalOptions
+	// 以下字段由 machine.mu 保护，和状态机的状态一起修改
+	log     *os.File
+	size    int64 // 日志里有效记录的总长度，转换被拒绝时截回这里
+	seq     uint64
+	pending int // 上次快照之后的记录数
+}
+
+// 打开目录 dir 下的日志，从快照和日志中恢复状态机，目录为空时用 newCtx 创建新的上下文
+func OpenJournal[C any](dir string, def *Definition[C], newCtx func() C, opts JournalOptions) (*Journal[C], error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	j := &Journal[C]{dir: dir, opts: opts}
+	ctx := newCtx()
+	var snap *machineSnapshot
+	data, err := os.ReadFile(j.snapshotPath())
+	switch {
+	case err == nil:
+		snap = &machineSnapshot{}
+		if err := json.Unmarshal(data, snap); err != nil {
+			return nil, fmt.Errorf("decode snapshot: %w", err)
+		}
+		if snap.Version != journalVersion {
+			return nil, &VersionError{Seq: snap.Seq, Version: snap.Version}
+		}
+		if err := json.Unmarshal(snap.Context, &ctx); err != nil {
+			return nil, fmt.Errorf("decode snapshot context: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	if def.Initial == "" {
+		return nil, errors.New("state machine has no initial state")
+	}
+	// 从快照恢复时像正常转换一样进入快照中的状态，进入钩子会执行，这个状态上的定时器会重新计时
+	start := def.Initial
+	if snap != nil {
+		if !slices.Contains(def.states(), snap.State) {
+			return nil, fmt.Errorf("snapshot state %s is not defined", snap.State)
+		}
+		start = snap.State
+		j.seq = snap.Seq
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	// 定时器触发的事件也要先写日志
+	fireTimeout := func(event EventID) error { return j.fireLocked(event, nil, nil) }
+	if j.machine, err = newMachine(def, ctx, clock, start, fireTimeout); err != nil {
+		return nil, err
+	}
+	// 进入初始状态和重放都在同一次持有锁期间完成，定时器要等日志打开之后才能触发
+	j.machine.mu.Lock()
+	defer j.machine.mu.Unlock()
+	j.machine.start()
+	if err := j.replay(); err != nil {
+		j.machine.stopTimersLocked()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal[C]) snapshotPath() string {
+	return filepath.Join(j.dir, "snapshot.json")
+}
+
+// 重放快照之后的记录，调用时持有 machine.mu。
+// 只有最后一条没写完（没有换行）的记录会被截掉，其余任何解析不了、序号不连续或者重放失败的记录都返回错误，不会悄悄丢掉后面的事件
+func (j *Journal[C]) replay() error {
+	f, err := os.OpenFile(filepath.Join(j.dir, "journal.log"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	var good int64
+	for len(data[good:]) > 0 {
+		line, _, found := bytes.Cut(data[good:], []byte("\n"))
+		if !found {
+			break
+		}
+		end := good + int64(len(line)) + 1
+		var r journalRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			f.Close()
+			return fmt.Errorf("journal corrupted at offset %d: %w", good, err)
+		}
+		if r.Seq <= j.seq {
+			// 已经包含在快照里
+			good = end
+			continue
+		}
+		if r.Seq != j.seq+1 {
+			f.Close()
+			return fmt.Errorf("journal corrupted at offset %d: got record %d, want %d", good, r.Seq, j.seq+1)
+		}
+		arg, err := j.decode(&r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if err := j.machine.fire(r.Event, arg); err != nil {
+			if end == int64(len(data)) {
+				// Fire 写入记录后转换被拒绝，还没来得及撤掉这条记录就崩溃了
+				break
+			}
+			f.Close()
+			return fmt.Errorf("replay journal record %d: %w", r.Seq, err)
+		}
+		good = end
+		j.seq = r.Seq
+		j.pending++
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	j.log = f
+	j.size = good
+	return nil
+}
+
+// 检查记录的版本和事件，解码事件参数
+func (j *Journal[C]) decode(r *journalRecord) (any, error) {
+	if r.Version != journalVersion || !j.known(r.Event) {
+		return nil, &VersionError{Seq: r.Seq, Version: r.Version, Event: r.Event}
+	}
+	if len(r.Arg) == 0 {
+		return nil, nil
+	}
+	decode, ok := j.opts.Args[r.Event]
+	if !ok {
+		return nil, &VersionError{Seq: r.Seq, Version: r.Version, Event: r.Event}
+	}
+	arg, err := decode(r.Arg)
+	if err != nil {
+		return nil, fmt.Errorf("decode argument of journal record %d: %w", r.Seq, err)
+	}
+	return arg, nil
+}
+
+func (j *Journal[C]) known(event EventID) bool {
+	for _, t := range j.machine.def.Transitions {
+		if t.Event == event {
+			return true
+		}
+	}
+	return false
+}
+
+// 只读地查看恢复出来的状态。不直接暴露 Machine，否则调用方可以绕过日志触发事件
+func (j *Journal[C]) Current() StateID {
+	return j.machine.Current()
+}
+
+// 返回上下文的副本。上下文通常是指针，直接返回会让调用方绕过日志修改它，读取时也会和 Fire 竞争，
+// 所以在锁内做一次 JSON 编解码（和快照用的是同一种序列化）得到深拷贝
+func (j *Journal[C]) Context() (C, error) {
+	j.machine.mu.Lock()
+	data, err := json.Marshal(j.machine.ctx)
+	j.machine.mu.Unlock()
+	var ctx C
+	if err != nil {
+		return ctx, err
+	}
+	// C 是指针时 Unmarshal 会分配一个新的值
+	err = json.Unmarshal(data, &ctx)
+	return ctx, err
+}
+
+// 触发事件。先把记录写入日志并落盘再修改内存中的状态，落盘失败时状态不变；转换被拒绝时把刚写入的记录撤掉
+func (j *Journal[C]) Fire(event EventID, arg any) error {
+	var raw json.RawMessage
+	if arg != nil {
+		if _, ok := j.opts.Args[event]; !ok {
+			return fmt.Errorf("event %s has no registered argument decoder", event)
+		}
+		var err error
+		if raw, err = json.Marshal(arg); err != nil {
+			return err
+		}
+	}
+	j.machine.mu.Lock()
+	defer j.machine.mu.Unlock()
+	return j.fireLocked(event, arg, raw)
+}
+
+func (j *Journal[C]) fireLocked(event EventID, arg any, raw json.RawMessage) error {
+	line, err := json.Marshal(journalRecord{Version: journalVersion, Seq: j.seq + 1, Event: event, Arg: raw})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := j.log.WriteAt(line, j.size); err != nil {
+		return err
+	}
+	if err := j.log.Sync(); err != nil {
+		return err
+	}
+	if err := j.machine.fire(event, arg); err != nil {
+		if terr := j.log.Truncate(j.size); terr != nil {
+			return errors.Join(err, terr)
+		}
+		return err
+	}
+	j.size += int64(len(line))
+	j.seq++
+	j.pending++
+	if j.opts.SnapshotEvery > 0 && j.pending >= j.opts.SnapshotEvery {
+		// 事件已经落盘并生效，快照失败不能报告给调用方，否则调用方重试会把事件执行两次。
+		// 日志还在，下一次转换时会再尝试保存快照
+		if err := j.snapshotLocked(); err != nil {
+			fmt.Printf("Snapshot journal failed: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// 保存快照并清空日志。快照落盘（包括目录）之后才清空日志；如果在清空日志之前崩溃，重放时会跳过快照已经包含的记录
+func (j *Journal[C]) Snapshot() error {
+	j.machine.mu.Lock()
+	defer j.machine.mu.Unlock()
+	return j.snapshotLocked()
+}
+
+func (j *Journal[C]) snapshotLocked() error {
+	ctx, err := json.Marshal(j.machine.ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(machineSnapshot{Version: journalVersion, Seq: j.seq, State: j.machine.current, Context: ctx})
+	if err != nil {
+		return err
+	}
+	if err := writeFileDurable(j.snapshotPath(), data); err != nil {
+		return err
+	}
+	if err := j.log.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	j.pending = 0
+	return nil
+}
+
+// 写入 path 并保证落盘：先写临时文件并 fsync，rename 之后再 fsync 所在目录，
+// 这样调用方随后清空日志时，崩溃也不会留下空的或只写了一半的快照
+func writeFileDurable(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// 关闭日志，之后不会再有定时器触发的事件
+func (j *Journal[C]) Close() error {
+	j.machine.mu.Lock()
+	defer j.machine.mu.Unlock()
+	j.machine.stopTimersLocked()
+	return j.log.Close()
+}
+
+func journalDemo() error {
+	dir, err := os.MkdirTemp("", "fsm")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	newCtx := func() *vendingContext { return &vendingContext{ItemCount: 1, ItemPrice: 10} }
+	opts := JournalOptions{
+		SnapshotEvery: 4,
+		Args: map[EventID]func(json.RawMessage) (any, error){
+			vmAddItem:     intArg,
+			vmInsertMoney: intArg,
+		},
+	}
+	j, err := OpenJournal(dir, vendingDefinition(), newCtx, opts)
+	if err != nil {
+		return err
+	}
+	for _, step := range []struct {
+		event EventID
+		arg   any
+	}{
+		{vmRequestItem, nil},
+		{vmInsertMoney, 10},
+		{vmDispenseItem, nil},
+		{vmAddItem, 3},
+		{vmRequestItem, nil},
+	} {
+		if err := j.Fire(step.event, step.arg); err != nil {
+			return err
+		}
+	}
+	j.Close()
+
+	// 模拟重启
+	if j, err = OpenJournal(dir, vendingDefinition(), newCtx, opts); err != nil {
+		return err
+	}
+	ctx, err := j.Context()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recovered state %s with %d items\n", j.Current(), ctx.ItemCount)
+	j.Close()
+
+	// 日志里混入了新版本程序写入的事件
+	f, err := os.OpenFile(filepath.Join(dir, "journal.log"), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(f, `{"v":1,"seq":6,"event":"refund"}`)
+	f.Close()
+	_, err = OpenJournal(dir, vendingDefinition(), newCtx, opts)
+	var versionErr *VersionError
+	if errors.As(err, &versionErr) {
+		fmt.Printf("Recovery refused: %v\n", err)
+		return marioJournalDemo()
+	}
+	return err
+}
+
+// 定时器触发的事件同样写进日志；从快照恢复到无敌星状态时，无敌星的定时器会重新计时
+func marioJournalDemo() error {
+	dir, err := os.MkdirTemp("", "mario")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	newCtx := func() *marioContext { return &marioContext{} }
+	open := func(clock Clock) (*Journal[*marioContext], error) {
+		return OpenJournal(dir, marioDefinition(), newCtx, JournalOptions{SnapshotEvery: 2, Clock: clock})
+	}
+	j, err := open(&manualClock{})
+	if err != nil {
+		return err
+	}
+	// 第二个事件之后保存快照，快照里的状态是 StarMario
+	for _, event := range []EventID{marioObtainMushroom, marioObtainStar} {
+		if err := j.Fire(event, nil); err != nil {
+			return err
+		}
+	}
+	j.Close()
+
+	fmt.Println("-------------------restart")
+	clock := &manualClock{}
+	if j, err = open(clock); err != nil {
+		return err
+	}
+	fmt.Println("-------------------10s later")
+	clock.Advance(marioStarDuration)
+	j.Close()
+
+	fmt.Println("-------------------restart")
+	if j, err = open(&manualClock{}); err != nil {
+		return err
+	}
+	defer j.Close()
+	ctx, err := j.Context()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recovered state %s with score %d\n", j.Current(), ctx.Score)
+	return nil
+}
+
+// 用状态机实现的售货机
+
+const (
+	vmHasItem       StateID = "HasItem"
+	vmItemRequested StateID = "ItemRequested"
+	vmHasMoney      StateID = "HasMoney"
+	vmNoItem        StateID = "NoItem"
+
+	vmRequestItem  EventID = "requestItem"
+	vmAddItem      EventID = "addItem"
+	vmInsertMoney  EventID = "insertMoney"
+	vmDispenseItem EventID = "dispenseItem"
+)
+
+// 字段导出以便快照时序列化
+type vendingContext struct {
+	ItemCount int
+	ItemPrice int
+}
+
+func newVendingMachineFSM(itemCount, itemPrice int) (*Machine[*vendingContext], error) {
+	def := vendingDefinition()
+	if itemCount == 0 {
+		def.Initial = vmNoItem
+	}
+	return NewMachine(def, &vendingContext{ItemCount: itemCount, ItemPrice: itemPrice})
+}
+
+// 取出 int 类型的事件参数，类型不对时返回错误而不是 panic
+func intFrom(event EventID, arg any) (int, error) {
+	n, ok := arg.(int)
+	if !ok {
+		return 0, fmt.Errorf("event %s wants an int argument, got %T", event, arg)
+	}
+	return n, nil
+}
+
+func vendingDefinition() *Definition[*vendingContext] {
+	addItems := func(v *vendingContext, arg any) error {
+		count, err := intFrom(vmAddItem, arg)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Adding %d items\n", count)
+		v.ItemCount += count
+		return nil
+	}
+	dispense := func(v *vendingContext, arg any) error {
+		fmt.Println("Dispensing Item")
+		v.ItemCount--
+		return nil
+	}
+	return &Definition[*vendingContext]{
+		Initial: vmHasItem,
+		Transitions: []Transition[*vendingContext]{
+			{From: vmHasItem, Event: vmRequestItem, To: vmItemRequested},
+			{From: vmHasItem, Event: vmAddItem, Action: addItems},
+			{From: vmNoItem, Event: vmAddItem, To: vmHasItem, Action: addItems},
+			{From: vmItemRequested, Event: vmInsertMoney, To: vmHasMoney, Label: "money >= itemPrice", Guard: func(v *vendingContext, arg any) error {
+				money, err := intFrom(vmInsertMoney, arg)
+				if err != nil {
+					return err
+				}
+				if money < v.ItemPrice {
+					return fmt.Errorf("inserted money is less, please insert %d", v.ItemPrice)
+				}
+				return nil
+			}},
+			{From: vmHasMoney, Event: vmDispenseItem, To: vmNoItem, Action: dispense, Label: "last item", Guard: func(v *vendingContext, arg any) error {
+				if v.ItemCount > 1 {
+					return errors.New("items left")
+				}
+				return nil
+			}},
+			{From: vmHasMoney, Event: vmDispenseItem, To: vmHasItem, Action: dispense, Label: "items left"},
+		},
+	}
+}
+
+// 用状态机实现的马里奥
+// 超级马里奥、斗篷马里奥和无敌星马里奥都是 Powered 的子状态，遇到怪兽等共同行为只在 Powered 上声明一次。
+// 被怪兽打中后进入 HurtMario，短时间内无敌，之后变回小马里奥；无敌星在 10 秒后失效。
+
+const (
+	marioSmall   StateID = "SmallMario"
+	marioPowered StateID = "Powered"
+	marioSuper   StateID = "SuperMario"
+	marioCape    StateID = "CapeMario"
+	marioStar    StateID = "StarMario"
+	marioHurt    StateID = "HurtMario"
+
+	marioObtainMushroom     EventID = "ObtainMushroom"
+	marioObtainCape         EventID = "ObtainCape"
+	marioObtainStar         EventID = "ObtainStar"
+	marioMeetMonster        EventID = "MeetMonster"
+	marioStarExpired        EventID = "StarExpired"
+	marioInvincibilityEnded EventID = "InvincibilityEnded"
+
+	marioStarDuration          = 10 * time.Second
+	marioInvincibilityDuration = 2 * time.Second
+)
+
+type marioContext struct {
+	Score int64
+}
+
+func newMarioFSM(clock Clock) (*Machine[*marioContext], error) {
+	return NewMachineWithClock(marioDefinition(), &marioContext{}, clock)
+}
+
+func marioDefinition() *Definition[*marioContext] {
+	score := func(delta int64) func(*marioContext, any) error {
+		return func(m *marioContext, arg any) error {
+			m.Score += delta
+			return nil
+		}
+	}
+	def := &Definition[*marioContext]{
+		Initial: marioSmall,
+		Transitions: []Transition[*marioContext]{
+			{From: marioSmall, Event: marioObtainMushroom, To: marioSuper, Action: score(100)},
+			{From: marioSmall, Event: marioObtainCape, To: marioCape, Action: score(200)},
+			{From: marioSmall, Event: marioObtainStar, To: marioStar, Action: score(500)},
+			{From: marioSmall, Event: marioMeetMonster, Action: score(-100)},
+			{From: marioPowered, Event: marioObtainMushroom},
+			{From: marioPowered, Event: marioObtainCape, To: marioCape, Action: score(200)},
+			{From: marioPowered, Event: marioObtainStar, To: marioStar, Action: score(500)},
+			{From: marioPowered, Event: marioMeetMonster, To: marioHurt, Action: score(-200)},
+			{From: marioCape, Event: marioObtainCape},
+			{From: marioStar, Event: marioMeetMonster, Action: score(100), Label: "invincible"},
+			{From: marioStar, Event: marioStarExpired, To: marioSuper},
+			{From: marioHurt, Event: marioMeetMonster, Label: "invincible"},
+			{From: marioHurt, Event: marioInvincibilityEnded, To: marioSmall},
+		},
+		Parents: map[StateID]StateID{
+			marioSuper: marioPowered,
+			marioCape:  marioPowered,
+			marioStar:  marioPowered,
+		},
+		Timeouts: []Timeout{
+			{State: marioStar, After: marioStarDuration, Event: marioStarExpired},
+			{State: marioHurt, After: marioInvincibilityDuration, Event: marioInvincibilityEnded},
+		},
+		OnEnter: map[StateID]func(*marioContext){},
+	}
+	for _, s := range []StateID{marioSmall, marioSuper, marioCape, marioStar, marioHurt} {
+		def.OnEnter[s] = func(m *marioContext) {
+			fmt.Printf("%s, score %d\n", s, m.Score)
+		}
+	}
+	return def
+}
+
+func main() {
+	vm, err := newVendingMachineFSM(1, 10)
+	if err != nil {
+		log.Fatal(err)
+	}
+	steps := []struct {
+		event EventID
+		arg   any
+	}{
+		{vmRequestItem, nil},
+		{vmInsertMoney, 10},
+		{vmDispenseItem, nil},
+		{vmRequestItem, nil},
+		{vmAddItem, 2},
+		{vmRequestItem, nil},
+		{vmInsertMoney, "ten"},
+		{vmInsertMoney, 5},
+		{vmInsertMoney, 10},
+		{vmDispenseItem, nil},
+	}
+	for _, step := range steps {
+		if err := vm.Fire(step.event, step.arg); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("%s -> %s\n", step.event, vm.Current())
+	}
+	fmt.Println()
+	fmt.Print(vm.DOT())
+
+	fmt.Println()
+	clock := &manualClock{}
+	mario, err := newMarioFSM(clock)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, event := range []EventID{marioObtainMushroom, marioObtainCape, marioMeetMonster, marioMeetMonster} {
+		fmt.Printf("-------------------%s\n", event)
+		if err := mario.Fire(event, nil); err != nil {
+			fmt.Println(err)
+		}
+	}
+	fmt.Println("-------------------2s later")
+	clock.Advance(marioInvincibilityDuration)
+	for _, event := range []EventID{marioObtainStar, marioMeetMonster} {
+		fmt.Printf("-------------------%s\n", event)
+		if err := mario.Fire(event, nil); err != nil {
+			fmt.Println(err)
+		}
+	}
+	fmt.Println("-------------------10s later")
+	clock.Advance(marioStarDuration)
+	fmt.Println()
+	fmt.Print(mario.Mermaid())
+
+	fmt.Println()
+	if err := journalDemo(); err != nil {
+		fmt.Println(err)
+	}
+}
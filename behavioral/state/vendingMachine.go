@@ -1,10 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 )
 
+var (
+	errCannotMakeChange = errors.New("cannot make exact change")
+	errMachineBusy      = errors.New("machine is in use by another session")
+	errSessionExpired   = errors.New("session is no longer active")
+)
+
+// 货道，每个货道有自己的价格和库存
+type slot struct {
+	price int
+	count int
+}
+
 type VendingMachine struct {
 	// 有商品
 	hasItem State
@@ -17,14 +39,35 @@ type VendingMachine struct {
 
 	currentState State
 
-	itemCount int
-	itemPrice int
+	slots map[string]*slot
+	// 找零用的硬币/纸币库存，面额 -> 数量
+	coins map[int]int
+
+	// 当前交易：选中的货道、已投入的钱、计算好的找零
+	selected string
+	inserted []int
+	change   []int
+
+	// 保护以上所有字段，所有操作都在持有锁时进行
+	mu sync.Mutex
+	// 当前占用售货机的会话，为空表示空闲
+	owner *session
+	// 会话结束时关闭，等待占用的顾客据此醒来
+	released chan struct{}
+
+	// 不为空时每个操作都先写进日志，重启后可以恢复货道、零钱和进行中的交易
+	journal *vmJournal
+	// 重放日志时不打印提示
+	replaying bool
 }
 
-func newVendingMachine(itemCount, itemPrice int) *VendingMachine {
+func newVendingMachine(denominations ...int) *VendingMachine {
 	v := &VendingMachine{
-		itemCount: itemCount,
-		itemPrice: itemPrice,
+		slots: make(map[string]*slot),
+		coins: make(map[int]int),
+	}
+	for _, d := range denominations {
+		v.coins[d] = 0
 	}
 	hasItemState := &HasItemState{
 		vendingMachine: v,
@@ -39,7 +82,7 @@ func newVendingMachine(itemCount, itemPrice int) *VendingMachine {
 		vendingMachine: v,
 	}
 
-	v.setState(hasItemState)
+	v.setState(noItemState)
 	v.hasItem = hasItemState
 	v.itemRequested = itemRequestedState
 	v.hasMoney = hasMoneyState
@@ -47,48 +90,574 @@ func newVendingMachine(itemCount, itemPrice int) *VendingMachine {
 	return v
 }
 
-func (v *VendingMachine) requestItem() error {
-	return v.currentState.requestItem()
+// 新增或调整一个货道的价格
+func (v *VendingMachine) addSlot(code string, price int) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, err := v.execLocked(vmOp{Kind: opAddSlot, Code: code, Value: price})
+	return err
+}
+
+// 补充找零用的零钱
+func (v *VendingMachine) addCoins(denomination, count int) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, err := v.execLocked(vmOp{Kind: opAddCoins, Value: denomination, Count: count})
+	return err
+}
+
+// 不通过会话直接操作售货机，售货机被某个会话占用时返回 errMachineBusy
+func (v *VendingMachine) requestItem(code string) error {
+	return v.withoutSession(vmOp{Kind: opRequestItem, Code: code})
 }
 
-func (v *VendingMachine) addItem(count int) error {
-	return v.currentState.addItem(count)
+func (v *VendingMachine) addItem(code string, count int) error {
+	return v.withoutSession(vmOp{Kind: opAddItem, Code: code, Count: count})
 }
 
 func (v *VendingMachine) insertMoney(money int) error {
-	return v.currentState.insertMoney(money)
+	return v.withoutSession(vmOp{Kind: opInsertMoney, Value: money})
 }
 
 func (v *VendingMachine) dispenseItem() error {
-	return v.currentState.dispenseItem()
+	return v.withoutSession(vmOp{Kind: opDispenseItem})
+}
+
+// 取消交易，退回已投入的钱，任何状态下都可以调用
+func (v *VendingMachine) cancel() []int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.owner != nil {
+		return nil
+	}
+	refund, err := v.execLocked(vmOp{Kind: opCancel})
+	if err != nil {
+		fmt.Println(err)
+	}
+	return refund
+}
+
+func (v *VendingMachine) withoutSession(op vmOp) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.owner != nil {
+		return errMachineBusy
+	}
+	_, err := v.execLocked(op)
+	return err
+}
+
+func (v *VendingMachine) printf(format string, args ...any) {
+	if !v.replaying {
+		fmt.Printf(format, args...)
+	}
+}
+
+// 操作日志
+// 售货机的每个操作都是一条 vmOp。有日志时 execLocked 先把操作写入日志并落盘，再修改内存中的状态；
+// 重启后从最近的快照开始按顺序重放，货道、零钱和进行中的交易都能恢复。执行失败的操作同样留在日志里，
+// 比如找不开零钱时会退款，重放时它会以同样的方式失败，所以状态保持一致。
+
+const (
+	opAddSlot      = "addSlot"
+	opAddCoins     = "addCoins"
+	opAddItem      = "addItem"
+	opRequestItem  = "requestItem"
+	opInsertMoney  = "insertMoney"
+	opDispenseItem = "dispenseItem"
+	opCancel       = "cancel"
+)
+
+type vmOp struct {
+	Seq   uint64 `json:"seq"`
+	Kind  string `json:"op"`
+	Code  string `json:"code,omitempty"`
+	Value int    `json:"value,omitempty"` // 价格、面额或投入的钱
+	Count int    `json:"count,omitempty"`
+}
+
+// 只在没有进行中的交易时保存，所以只需要货道和零钱
+type vmSnapshot struct {
+	Seq   uint64                  `json:"seq"`
+	Slots map[string]slotSnapshot `json:"slots"`
+	Coins map[int]int             `json:"coins"`
+}
+
+type slotSnapshot struct {
+	Price int `json:"price"`
+	Count int `json:"count"`
+}
+
+// 由 VendingMachine.mu 保护
+type vmJournal struct {
+	dir           string
+	snapshotEvery int
+	log           *os.File
+	size          int64
+	seq           uint64
+	pending       int // 上次快照之后的记录数
+}
+
+// 打开目录 dir 下的日志并恢复售货机。重启前进行中的交易已经没有会话了，恢复后退款并结束它
+func openVendingMachine(dir string, snapshotEvery int, denominations ...int) (*VendingMachine, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	v := newVendingMachine(denominations...)
+	j := &vmJournal{dir: dir, snapshotEvery: snapshotEvery}
+	data, err := os.ReadFile(j.snapshotPath())
+	switch {
+	case err == nil:
+		var snap vmSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, fmt.Errorf("decode vending snapshot: %w", err)
+		}
+		for code, s := range snap.Slots {
+			v.slots[code] = &slot{price: s.Price, count: s.Count}
+		}
+		for d, n := range snap.Coins {
+			v.coins[d] = n
+		}
+		j.seq = snap.Seq
+		v.endTransaction()
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.replayLocked(j); err != nil {
+		return nil, err
+	}
+	v.journal = j
+	if v.selected != "" {
+		fmt.Printf("Cancelling transaction for %s interrupted by restart\n", v.selected)
+		if _, err := v.execLocked(vmOp{Kind: opCancel}); err != nil {
+			j.log.Close()
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func (j *vmJournal) snapshotPath() string {
+	return filepath.Join(j.dir, "vending.snapshot")
+}
+
+// 只有最后一条没写完（没有换行）的记录会被截掉，其余解析不了、序号不连续或者不认识的记录都返回错误
+func (v *VendingMachine) replayLocked(j *vmJournal) error {
+	f, err := os.OpenFile(filepath.Join(j.dir, "vending.log"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	v.replaying = true
+	defer func() { v.replaying = false }()
+	var good int64
+	for len(data[good:]) > 0 {
+		line, _, found := bytes.Cut(data[good:], []byte("\n"))
+		if !found {
+			break
+		}
+		var op vmOp
+		if err := json.Unmarshal(line, &op); err != nil {
+			f.Close()
+			return fmt.Errorf("vending log corrupted at offset %d: %w", good, err)
+		}
+		good += int64(len(line)) + 1
+		if op.Seq <= j.seq {
+			// 已经包含在快照里
+			continue
+		}
+		if op.Seq != j.seq+1 {
+			f.Close()
+			return fmt.Errorf("vending log corrupted: got record %d, want %d", op.Seq, j.seq+1)
+		}
+		// 失败的操作在写日志时也失败了，重放得到同样的结果，所以忽略它的错误
+		if _, err := v.apply(op); errors.Is(err, errUnknownOp) {
+			f.Close()
+			return fmt.Errorf("vending log record %d: %w", op.Seq, err)
+		}
+		j.seq = op.Seq
+		j.pending++
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	j.log = f
+	j.size = good
+	return nil
+}
+
+// 执行一个操作，调用时持有 v.mu。有日志时先写日志并落盘，写入失败时状态不变
+func (v *VendingMachine) execLocked(op vmOp) ([]int, error) {
+	j := v.journal
+	if j == nil {
+		return v.apply(op)
+	}
+	op.Seq = j.seq + 1
+	line, err := json.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	line = append(line, '\n')
+	if _, err := j.log.WriteAt(line, j.size); err != nil {
+		return nil, err
+	}
+	if err := j.log.Sync(); err != nil {
+		return nil, err
+	}
+	j.size += int64(len(line))
+	j.seq++
+	j.pending++
+	refund, err := v.apply(op)
+	if j.snapshotEvery > 0 && j.pending >= j.snapshotEvery && v.selected == "" {
+		if serr := v.snapshotLocked(); serr != nil {
+			fmt.Printf("Snapshot vending machine failed: %v\n", serr)
+		}
+	}
+	return refund, err
+}
+
+var errUnknownOp = errors.New("unknown operation")
+
+func (v *VendingMachine) apply(op vmOp) ([]int, error) {
+	switch op.Kind {
+	case opAddSlot:
+		if s, ok := v.slots[op.Code]; ok {
+			s.price = op.Value
+		} else {
+			v.slots[op.Code] = &slot{price: op.Value}
+		}
+		return nil, nil
+	case opAddCoins:
+		if _, ok := v.coins[op.Value]; !ok {
+			return nil, fmt.Errorf("Unsupported denomination %d", op.Value)
+		}
+		v.coins[op.Value] += op.Count
+		return nil, nil
+	case opAddItem:
+		return nil, v.currentState.addItem(op.Code, op.Count)
+	case opRequestItem:
+		return nil, v.currentState.requestItem(op.Code)
+	case opInsertMoney:
+		return nil, v.currentState.insertMoney(op.Value)
+	case opDispenseItem:
+		return nil, v.currentState.dispenseItem()
+	case opCancel:
+		return v.currentState.cancel(), nil
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownOp, op.Kind)
+}
+
+// 保存快照并清空日志，快照落盘（包括目录）之后才清空日志
+func (v *VendingMachine) snapshotLocked() error {
+	j := v.journal
+	snap := vmSnapshot{Seq: j.seq, Slots: make(map[string]slotSnapshot, len(v.slots)), Coins: v.coins}
+	for code, s := range v.slots {
+		snap.Slots[code] = slotSnapshot{Price: s.price, Count: s.count}
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileDurable(j.snapshotPath(), data); err != nil {
+		return err
+	}
+	if err := j.log.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	j.pending = 0
+	return nil
+}
+
+// 写入 path 并保证落盘：先写临时文件并 fsync，rename 之后再 fsync 所在目录，
+// 这样调用方随后清空日志时，崩溃也不会留下空的或只写了一半的快照
+func writeFileDurable(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (v *VendingMachine) close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.journal == nil {
+		return nil
+	}
+	return v.journal.log.Close()
+}
+
+// 顾客会话
+// 从选择商品到出货，整个过程由一个会话独占售货机，其他顾客要等它结束。会话空闲超过 idleTimeout 会被自动结束，
+// 已投入的钱退回，售货机释放给下一个顾客。
+type session struct {
+	machine     *VendingMachine
+	customer    string
+	idleTimeout time.Duration
+	timer       *time.Timer
+	// 空闲超时的截止时间，每次操作都会推后。定时器可能在操作持有锁时到期，expire 拿到锁后据此判断是否真的超时
+	deadline time.Time
+}
+
+// 等待售货机空闲并占用它，ctx 结束时放弃等待
+func (v *VendingMachine) beginSession(ctx context.Context, customer string, idleTimeout time.Duration) (*session, error) {
+	for {
+		v.mu.Lock()
+		if v.owner == nil {
+			s := &session{
+				machine:     v,
+				customer:    customer,
+				idleTimeout: idleTimeout,
+				deadline:    time.Now().Add(idleTimeout),
+			}
+			s.timer = time.AfterFunc(idleTimeout, s.expire)
+			v.owner = s
+			v.released = make(chan struct{})
+			v.mu.Unlock()
+			return s, nil
+		}
+		released := v.released
+		v.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 在持有锁且确认会话仍然有效时执行 fn，并重新计算空闲超时
+func (s *session) do(fn func() error) error {
+	v := s.machine
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.owner != s {
+		return errSessionExpired
+	}
+	s.deadline = time.Now().Add(s.idleTimeout)
+	s.timer.Reset(s.idleTimeout)
+	return fn()
+}
+
+func (s *session) requestItem(code string) error {
+	return s.do(func() error {
+		_, err := s.machine.execLocked(vmOp{Kind: opRequestItem, Code: code})
+		return err
+	})
+}
+
+func (s *session) insertMoney(money int) error {
+	return s.do(func() error {
+		_, err := s.machine.execLocked(vmOp{Kind: opInsertMoney, Value: money})
+		return err
+	})
+}
+
+// 出货成功后会话自动结束
+func (s *session) dispenseItem() error {
+	return s.do(func() error {
+		if _, err := s.machine.execLocked(vmOp{Kind: opDispenseItem}); err != nil {
+			return err
+		}
+		s.releaseLocked()
+		return nil
+	})
+}
+
+// 取消交易并结束会话
+func (s *session) cancel() []int {
+	var refund []int
+	s.do(func() error {
+		var err error
+		if refund, err = s.machine.execLocked(vmOp{Kind: opCancel}); err != nil {
+			fmt.Println(err)
+		}
+		s.releaseLocked()
+		return nil
+	})
+	return refund
+}
+
+func (s *session) expire() {
+	v := s.machine
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.owner != s {
+		return
+	}
+	// 到期后、拿到锁之前会话又有了操作，按新的截止时间重新计时
+	if remaining := time.Until(s.deadline); remaining > 0 {
+		s.timer.Reset(remaining)
+		return
+	}
+	fmt.Printf("Session of %s timed out\n", s.customer)
+	if _, err := v.execLocked(vmOp{Kind: opCancel}); err != nil {
+		fmt.Println(err)
+	}
+	s.releaseLocked()
+}
+
+func (s *session) releaseLocked() {
+	s.timer.Stop()
+	s.machine.owner = nil
+	close(s.machine.released)
 }
 
 func (v *VendingMachine) setState(s State) {
 	v.currentState = s
 }
 
-func (v *VendingMachine) incrementItemCount(count int) {
-	fmt.Printf("Adding %d items\n", count)
-	v.itemCount = v.itemCount + count
+func (v *VendingMachine) incrementItemCount(code string, count int) error {
+	s, ok := v.slots[code]
+	if !ok {
+		return fmt.Errorf("Unknown slot %s", code)
+	}
+	v.printf("Adding %d items to slot %s\n", count, code)
+	s.count = s.count + count
+	return nil
+}
+
+func (v *VendingMachine) totalItems() int {
+	total := 0
+	for _, s := range v.slots {
+		total += s.count
+	}
+	return total
+}
+
+func (v *VendingMachine) insertedAmount() int {
+	total := 0
+	for _, m := range v.inserted {
+		total += m
+	}
+	return total
+}
+
+// 退回已投入的钱并结束当前交易
+func (v *VendingMachine) refund() []int {
+	refund := v.inserted
+	if len(refund) > 0 {
+		v.printf("Refunding %v\n", refund)
+	}
+	v.endTransaction()
+	return refund
+}
+
+func (v *VendingMachine) endTransaction() {
+	v.selected = ""
+	v.inserted = nil
+	v.change = nil
+	if v.totalItems() == 0 {
+		v.setState(v.noItem)
+	} else {
+		v.setState(v.hasItem)
+	}
+}
+
+// 用库存里的零钱加上本次投入的钱凑出恰好 amount 的找零，使用的张数最少，凑不出时返回 errCannotMakeChange
+func (v *VendingMachine) makeChange(amount int) ([]int, error) {
+	available := make(map[int]int, len(v.coins))
+	for d, n := range v.coins {
+		available[d] = n
+	}
+	for _, m := range v.inserted {
+		available[m]++
+	}
+	denominations := make([]int, 0, len(available))
+	for d := range available {
+		denominations = append(denominations, d)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(denominations)))
+
+	type key struct{ index, amount int }
+	memo := make(map[key][]int)
+	var solve func(index, amount int) []int
+	// 返回凑出 amount 的方案，凑不出时返回 nil；amount 为 0 时返回空切片
+	solve = func(index, amount int) []int {
+		if amount == 0 {
+			return []int{}
+		}
+		if index == len(denominations) {
+			return nil
+		}
+		k := key{index, amount}
+		if plan, ok := memo[k]; ok {
+			return plan
+		}
+		d := denominations[index]
+		var best []int
+		for n := min(available[d], amount/d); n >= 0; n-- {
+			rest := solve(index+1, amount-n*d)
+			if rest == nil {
+				continue
+			}
+			if best == nil || n+len(rest) < len(best) {
+				best = make([]int, 0, n+len(rest))
+				for i := 0; i < n; i++ {
+					best = append(best, d)
+				}
+				best = append(best, rest...)
+			}
+		}
+		memo[k] = best
+		return best
+	}
+	plan := solve(0, amount)
+	if plan == nil {
+		return nil, fmt.Errorf("%w for %d", errCannotMakeChange, amount)
+	}
+	return plan, nil
 }
 
 type State interface {
-	addItem(int) error
-	requestItem() error
+	addItem(code string, count int) error
+	requestItem(code string) error
 	insertMoney(money int) error
 	dispenseItem() error
+	cancel() []int
 }
 
 type NoItemState struct {
 	vendingMachine *VendingMachine
 }
 
-func (i *NoItemState) requestItem() error {
+func (i *NoItemState) requestItem(code string) error {
 	return fmt.Errorf("Item out of stock")
 }
 
-func (i *NoItemState) addItem(count int) error {
-	i.vendingMachine.incrementItemCount(count)
+func (i *NoItemState) addItem(code string, count int) error {
+	if err := i.vendingMachine.incrementItemCount(code, count); err != nil {
+		return err
+	}
 	i.vendingMachine.setState(i.vendingMachine.hasItem)
 	return nil
 }
@@ -99,25 +668,30 @@ func (i *NoItemState) insertMoney(money int) error {
 func (i *NoItemState) dispenseItem() error {
 	return fmt.Errorf("Item out of stock")
 }
+func (i *NoItemState) cancel() []int {
+	return i.vendingMachine.refund()
+}
 
 type HasItemState struct {
 	vendingMachine *VendingMachine
 }
 
-func (i *HasItemState) requestItem() error {
-	if i.vendingMachine.itemCount == 0 {
-		i.vendingMachine.setState(i.vendingMachine.noItem)
-		return fmt.Errorf("No item present")
+func (i *HasItemState) requestItem(code string) error {
+	s, ok := i.vendingMachine.slots[code]
+	if !ok {
+		return fmt.Errorf("Unknown slot %s", code)
+	}
+	if s.count == 0 {
+		return fmt.Errorf("Slot %s out of stock", code)
 	}
-	fmt.Printf("Item requestd\n")
+	i.vendingMachine.printf("Item %s requestd, price %d\n", code, s.price)
+	i.vendingMachine.selected = code
 	i.vendingMachine.setState(i.vendingMachine.itemRequested)
 	return nil
 }
 
-func (i *HasItemState) addItem(count int) error {
-	fmt.Printf("%d items added\n", count)
-	i.vendingMachine.incrementItemCount(count)
-	return nil
+func (i *HasItemState) addItem(code string, count int) error {
+	return i.vendingMachine.incrementItemCount(code, count)
 }
 
 func (i *HasItemState) insertMoney(money int) error {
@@ -126,96 +700,259 @@ func (i *HasItemState) insertMoney(money int) error {
 func (i *HasItemState) dispenseItem() error {
 	return fmt.Errorf("Please select item first")
 }
+func (i *HasItemState) cancel() []int {
+	return i.vendingMachine.refund()
+}
 
 type ItemRequestedState struct {
 	vendingMachine *VendingMachine
 }
 
-func (i *ItemRequestedState) requestItem() error {
+func (i *ItemRequestedState) requestItem(code string) error {
 	return fmt.Errorf("Item already requested")
 }
 
-func (i *ItemRequestedState) addItem(count int) error {
+func (i *ItemRequestedState) addItem(code string, count int) error {
 	return fmt.Errorf("Item Dispense in progress")
 }
 
+// 可以分多次投入，钱够了之后先确认能找零，找不开就退钱并拒绝这次交易
 func (i *ItemRequestedState) insertMoney(money int) error {
-	if money < i.vendingMachine.itemPrice {
-		return fmt.Errorf("Inserted money is less. Please insert %d", i.vendingMachine.itemPrice)
+	v := i.vendingMachine
+	if _, ok := v.coins[money]; !ok {
+		return fmt.Errorf("Unsupported denomination %d", money)
+	}
+	v.inserted = append(v.inserted, money)
+	price := v.slots[v.selected].price
+	if v.insertedAmount() < price {
+		v.printf("Inserted %d, please insert %d more\n", v.insertedAmount(), price-v.insertedAmount())
+		return nil
 	}
-	fmt.Println("Money entered is ok")
-	i.vendingMachine.setState(i.vendingMachine.hasMoney)
+	change, err := v.makeChange(v.insertedAmount() - price)
+	if err != nil {
+		v.refund()
+		return err
+	}
+	v.printf("Money entered is ok\n")
+	v.change = change
+	v.setState(v.hasMoney)
 	return nil
 }
 func (i *ItemRequestedState) dispenseItem() error {
 	return fmt.Errorf("Please insert money first")
 }
+func (i *ItemRequestedState) cancel() []int {
+	return i.vendingMachine.refund()
+}
 
 type HasMoneyState struct {
 	vendingMachine *VendingMachine
 }
 
-func (i *HasMoneyState) requestItem() error {
+func (i *HasMoneyState) requestItem(code string) error {
 	return fmt.Errorf("Item dispense in progress")
 }
 
-func (i *HasMoneyState) addItem(count int) error {
+func (i *HasMoneyState) addItem(code string, count int) error {
 	return fmt.Errorf("Item dispense in progress")
 }
 
 func (i *HasMoneyState) insertMoney(money int) error {
-	return fmt.Errorf("Item out of stock")
+	return fmt.Errorf("Item dispense in progress")
 }
 func (i *HasMoneyState) dispenseItem() error {
-	fmt.Println("Dispensing Item")
-	i.vendingMachine.itemCount = i.vendingMachine.itemCount - 1
-	if i.vendingMachine.itemCount == 0 {
-		i.vendingMachine.setState(i.vendingMachine.noItem)
-	} else {
-		i.vendingMachine.setState(i.vendingMachine.hasItem)
+	v := i.vendingMachine
+	v.printf("Dispensing Item %s\n", v.selected)
+	v.slots[v.selected].count--
+	for _, m := range v.inserted {
+		v.coins[m]++
+	}
+	for _, m := range v.change {
+		v.coins[m]--
+	}
+	if len(v.change) > 0 {
+		v.printf("Returning change %v\n", v.change)
 	}
+	v.endTransaction()
 	return nil
 }
+func (i *HasMoneyState) cancel() []int {
+	return i.vendingMachine.refund()
+}
 
 func main() {
-	vendingMachine := newVendingMachine(1, 10)
+	vendingMachine := newVendingMachine(1, 5, 10, 20)
+	if err := vendingMachine.addSlot("A1", 7); err != nil {
+		log.Fatal(err)
+	}
+	if err := vendingMachine.addSlot("B1", 15); err != nil {
+		log.Fatal(err)
+	}
+	if err := vendingMachine.addCoins(1, 2); err != nil {
+		log.Fatal(err)
+	}
+	if err := vendingMachine.addCoins(5, 1); err != nil {
+		log.Fatal(err)
+	}
 
-	err := vendingMachine.requestItem()
+	err := vendingMachine.addItem("A1", 1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = vendingMachine.addItem("B1", 2)
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal(err)
 	}
 
+	fmt.Println()
+
+	// 7 元的商品投 10 元，零钱只有两个 1 元和一个 5 元，找不开 3 元，交易被拒绝并退钱
+	err = vendingMachine.requestItem("A1")
+	if err != nil {
+		log.Fatal(err)
+	}
 	err = vendingMachine.insertMoney(10)
 	if err != nil {
-		log.Fatalf(err.Error())
+		fmt.Println(err)
 	}
 
+	fmt.Println()
+
+	// 分两次投入 20 元，找零 5 元
+	err = vendingMachine.requestItem("B1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = vendingMachine.insertMoney(10)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = vendingMachine.insertMoney(10)
+	if err != nil {
+		log.Fatal(err)
+	}
 	err = vendingMachine.dispenseItem()
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal(err)
 	}
 
 	fmt.Println()
 
-	err = vendingMachine.addItem(2)
+	// 投了一半取消，退回已投入的钱
+	err = vendingMachine.requestItem("B1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = vendingMachine.insertMoney(10)
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal(err)
 	}
+	vendingMachine.cancel()
 
 	fmt.Println()
+	concurrentDemo()
 
-	err = vendingMachine.requestItem()
-	if err != nil {
-		log.Fatalf(err.Error())
+	fmt.Println()
+	if err := recoveryDemo(); err != nil {
+		fmt.Println(err)
 	}
+}
 
-	err = vendingMachine.insertMoney(10)
+// 售货机在交易进行到一半时重启，货道库存和零钱从日志恢复，没完成的交易被退款
+func recoveryDemo() error {
+	dir, err := os.MkdirTemp("", "vending")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	v, err := openVendingMachine(dir, 4, 5, 10)
 	if err != nil {
-		log.Fatalf(err.Error())
+		return err
+	}
+	if err := v.addSlot("D1", 5); err != nil {
+		return err
+	}
+	if err := v.addCoins(5, 2); err != nil {
+		return err
 	}
+	if err := v.addItem("D1", 3); err != nil {
+		return err
+	}
+	// 找零 5 元；出货后已经攒够 4 条记录且没有进行中的交易，会保存快照
+	for _, step := range []func() error{
+		func() error { return v.requestItem("D1") },
+		func() error { return v.insertMoney(10) },
+		func() error { return v.dispenseItem() },
+		func() error { return v.requestItem("D1") },
+		func() error { return v.insertMoney(5) },
+	} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	v.close()
 
-	err = vendingMachine.dispenseItem()
+	// 模拟重启
+	if v, err = openVendingMachine(dir, 4, 5, 10); err != nil {
+		return err
+	}
+	defer v.close()
+	fmt.Printf("Recovered %d items in slot D1, coins %v, state %T\n", v.slots["D1"].count, v.coins, v.currentState)
+	return nil
+}
+
+// 多个顾客同时抢购，每个顾客通过会话独占售货机，库存扣减不会丢失
+func concurrentDemo() {
+	v := newVendingMachine(5, 10)
+	if err := v.addSlot("C1", 5); err != nil {
+		log.Fatal(err)
+	}
+	if err := v.addItem("C1", 20); err != nil {
+		log.Fatal(err)
+	}
+
+	// 占着售货机不操作的顾客，超时后被释放
+	idle, err := v.beginSession(context.Background(), "idle", 50*time.Millisecond)
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal(err)
+	}
+	if err := idle.requestItem("C1"); err != nil {
+		log.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sold := 0
+	for n := 0; n < 30; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			s, err := v.beginSession(ctx, fmt.Sprintf("customer-%d", n), time.Second)
+			if err != nil {
+				return
+			}
+			if err := s.requestItem("C1"); err != nil {
+				s.cancel()
+				return
+			}
+			if err := s.insertMoney(5); err != nil {
+				s.cancel()
+				return
+			}
+			if err := s.dispenseItem(); err != nil {
+				s.cancel()
+				return
+			}
+			mu.Lock()
+			sold++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if err := idle.insertMoney(5); err != nil {
+		fmt.Printf("Idle customer: %v\n", err)
 	}
+	fmt.Printf("Sold %d items, %d left in slot C1\n", sold, v.slots["C1"].count)
 }
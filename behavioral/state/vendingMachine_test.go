@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func coinValue(coins map[int]int) int {
+	total := 0
+	for d, n := range coins {
+		total += d * n
+	}
+	return total
+}
+
+// 很多顾客同时开会话买东西，其中一部分中途取消，另有一个顾客投了钱后一直不操作。
+// 结束后卖出的加上剩下的等于初始库存，零钱库存里多出来的钱正好是卖出商品的货款
+func TestConcurrentSessions(t *testing.T) {
+	const (
+		stock     = 20
+		price     = 5
+		customers = 60
+	)
+	v := newVendingMachine(5, 10)
+	if err := v.addSlot("C1", price); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.addItem("C1", stock); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.addCoins(5, 4); err != nil {
+		t.Fatal(err)
+	}
+	initialCoins := coinValue(v.coins)
+
+	// 投了钱就不再操作的顾客，超时后钱被退回，售货机释放给其他人
+	idle, err := v.beginSession(context.Background(), "idle", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idle.requestItem("C1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := idle.insertMoney(10); err != nil {
+		t.Fatal(err)
+	}
+
+	var sold, cancelled atomic.Int32
+	var wg sync.WaitGroup
+	for n := 0; n < customers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			s, err := v.beginSession(ctx, fmt.Sprintf("customer-%d", n), time.Second)
+			if err != nil {
+				t.Errorf("customer-%d: %v", n, err)
+				return
+			}
+			if err := s.requestItem("C1"); err != nil {
+				// 卖完了
+				s.cancel()
+				return
+			}
+			// 一半的顾客付 10 块需要找零，零钱不够时交易被拒绝
+			money := []int{5, 10}[n%2]
+			if err := s.insertMoney(money); err != nil {
+				s.cancel()
+				return
+			}
+			if n%5 == 0 {
+				s.cancel()
+				cancelled.Add(1)
+				return
+			}
+			if err := s.dispenseItem(); err != nil {
+				t.Errorf("customer-%d: dispense: %v", n, err)
+				s.cancel()
+				return
+			}
+			sold.Add(1)
+		}()
+	}
+	wg.Wait()
+
+	if err := idle.insertMoney(5); !errors.Is(err, errSessionExpired) {
+		t.Errorf("idle session insertMoney: got %v, want %v", err, errSessionExpired)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.owner != nil {
+		t.Errorf("machine is still owned by %s", v.owner.customer)
+	}
+	if len(v.inserted) != 0 || v.selected != "" {
+		t.Errorf("transaction left open: selected %q, inserted %v", v.selected, v.inserted)
+	}
+	remaining := v.slots["C1"].count
+	if got := int(sold.Load()) + remaining; got != stock {
+		t.Errorf("sold %d + remaining %d = %d, want %d", sold.Load(), remaining, got, stock)
+	}
+	if sold.Load() == 0 || cancelled.Load() == 0 {
+		t.Errorf("sold %d, cancelled %d, want both to be non-zero", sold.Load(), cancelled.Load())
+	}
+	for d, n := range v.coins {
+		if n < 0 {
+			t.Errorf("coins[%d] = %d, want non-negative", d, n)
+		}
+	}
+	if got, want := coinValue(v.coins), initialCoins+int(sold.Load())*price; got != want {
+		t.Errorf("coin inventory worth %d, want %d (initial %d + %d sold at %d)", got, want, initialCoins, sold.Load(), price)
+	}
+}
@@ -1,90 +1,1695 @@
 package main
 
-import "fmt"
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 // 策略模式是一种行为设计模式， 它能让你定义一系列算法， 并将每种算法分别放入独立的类中， 以使算法的对象能够相互替换。
 
 // 策略接口
-type EvictionAlgo interface {
-	evict(c *Cache)
+// 每种淘汰策略自己维护需要的元数据，Cache 在新增、访问、删除键时通知策略，需要腾出空间时由策略选出被淘汰的键。
+type EvictionAlgo[K comparable] interface {
+	name() string
+	onAdd(key K)
+	onAccess(key K)
+	onRemove(key K)
+	// 选出并移除一个被淘汰的键，没有键时返回 false
+	evict() (K, bool)
+	// 切换策略时根据缓存里现有键的访问记录重建元数据
+	rebuild(entries []keyMeta[K])
 }
 
-type Fifo struct {
+// 缓存为每个键记录的访问信息，与具体策略无关，切换策略时用它重建新策略的元数据
+type keyMeta[K comparable] struct {
+	key      K
+	inserted uint64 // 加入时的逻辑时钟
+	accessed uint64 // 最近一次访问时的逻辑时钟
+	hits     int    // 加入以来的访问次数，包括加入那一次
 }
 
-func (l *Fifo) evict(c *Cache) {
-	fmt.Println("Evicting by fifo strtegy")
+func sortByAccess[K comparable](entries []keyMeta[K]) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].accessed < entries[j].accessed })
 }
 
-type Lru struct {
+// 先进先出：淘汰最早加入的键，访问不影响顺序
+type Fifo[K comparable] struct {
+	queue *list.List
+	items map[K]*list.Element
 }
 
-func (l *Lru) evict(c *Cache) {
-	fmt.Println("Evicting by lru strtegy")
+func newFifo[K comparable]() EvictionAlgo[K] {
+	return &Fifo[K]{
+		queue: list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+func (l *Fifo[K]) name() string {
+	return "fifo"
+}
+
+func (l *Fifo[K]) onAdd(key K) {
+	if _, ok := l.items[key]; !ok {
+		l.items[key] = l.queue.PushBack(key)
+	}
+}
+
+func (l *Fifo[K]) onAccess(key K) {
+}
+
+func (l *Fifo[K]) onRemove(key K) {
+	if e, ok := l.items[key]; ok {
+		l.queue.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+func (l *Fifo[K]) rebuild(entries []keyMeta[K]) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].inserted < entries[j].inserted })
+	l.queue.Init()
+	l.items = make(map[K]*list.Element, len(entries))
+	for _, e := range entries {
+		l.items[e.key] = l.queue.PushBack(e.key)
+	}
+}
+
+func (l *Fifo[K]) evict() (K, bool) {
+	e := l.queue.Front()
+	if e == nil {
+		var zero K
+		return zero, false
+	}
+	key := e.Value.(K)
+	l.onRemove(key)
+	return key, true
+}
+
+// 最近最少使用：双向链表按访问时间排序，表头是最近访问的，所有操作 O(1)
+type Lru[K comparable] struct {
+	order *list.List
+	items map[K]*list.Element
+}
+
+func newLru[K comparable]() EvictionAlgo[K] {
+	return &Lru[K]{
+		order: list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+func (l *Lru[K]) name() string {
+	return "lru"
+}
+
+func (l *Lru[K]) onAdd(key K) {
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.order.PushFront(key)
+}
+
+func (l *Lru[K]) onAccess(key K) {
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+func (l *Lru[K]) onRemove(key K) {
+	if e, ok := l.items[key]; ok {
+		l.order.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+func (l *Lru[K]) rebuild(entries []keyMeta[K]) {
+	sortByAccess(entries)
+	l.order.Init()
+	l.items = make(map[K]*list.Element, len(entries))
+	for _, e := range entries {
+		l.items[e.key] = l.order.PushFront(e.key)
+	}
+}
+
+func (l *Lru[K]) evict() (K, bool) {
+	e := l.order.Back()
+	if e == nil {
+		var zero K
+		return zero, false
+	}
+	key := e.Value.(K)
+	l.onRemove(key)
+	return key, true
+}
+
+// 最不经常使用：按访问次数分桶，每个桶内按最近访问排序，次数相同时淘汰桶里最久没访问的，所有操作 O(1)
+type Lfu[K comparable] struct {
+	items   map[K]*lfuEntry[K]
+	buckets map[int]*list.List // 访问次数 -> 该次数的键，表头是最近访问的
+	minFreq int
+}
+
+type lfuEntry[K comparable] struct {
+	key  K
+	freq int
+	elem *list.Element
+}
+
+func newLfu[K comparable]() EvictionAlgo[K] {
+	return &Lfu[K]{
+		items:   make(map[K]*lfuEntry[K]),
+		buckets: make(map[int]*list.List),
+	}
+}
+
+func (l *Lfu[K]) name() string {
+	return "lfu"
+}
+
+func (l *Lfu[K]) push(e *lfuEntry[K]) {
+	bucket, ok := l.buckets[e.freq]
+	if !ok {
+		bucket = list.New()
+		l.buckets[e.freq] = bucket
+	}
+	e.elem = bucket.PushFront(e)
+}
+
+func (l *Lfu[K]) unlink(e *lfuEntry[K]) {
+	bucket := l.buckets[e.freq]
+	bucket.Remove(e.elem)
+	if bucket.Len() == 0 {
+		delete(l.buckets, e.freq)
+	}
+}
+
+func (l *Lfu[K]) onAdd(key K) {
+	if _, ok := l.items[key]; ok {
+		l.onAccess(key)
+		return
+	}
+	e := &lfuEntry[K]{key: key, freq: 1}
+	l.items[key] = e
+	l.push(e)
+	l.minFreq = 1
+}
+
+func (l *Lfu[K]) onAccess(key K) {
+	e, ok := l.items[key]
+	if !ok {
+		return
+	}
+	l.unlink(e)
+	if e.freq == l.minFreq && l.buckets[e.freq] == nil {
+		l.minFreq++
+	}
+	e.freq++
+	l.push(e)
+}
+
+func (l *Lfu[K]) onRemove(key K) {
+	e, ok := l.items[key]
+	if !ok {
+		return
+	}
+	l.unlink(e)
+	delete(l.items, key)
+	if len(l.items) == 0 {
+		l.minFreq = 0
+	} else if l.buckets[l.minFreq] == nil {
+		// 删除是少数情况，这里重新找一遍最小次数
+		l.minFreq = 0
+		for f := range l.buckets {
+			if l.minFreq == 0 || f < l.minFreq {
+				l.minFreq = f
+			}
+		}
+	}
+}
+
+func (l *Lfu[K]) rebuild(entries []keyMeta[K]) {
+	sortByAccess(entries)
+	l.items = make(map[K]*lfuEntry[K], len(entries))
+	l.buckets = make(map[int]*list.List)
+	l.minFreq = 0
+	for _, meta := range entries {
+		e := &lfuEntry[K]{key: meta.key, freq: max(meta.hits, 1)}
+		l.items[meta.key] = e
+		l.push(e)
+		if l.minFreq == 0 || e.freq < l.minFreq {
+			l.minFreq = e.freq
+		}
+	}
+}
+
+func (l *Lfu[K]) evict() (K, bool) {
+	bucket := l.buckets[l.minFreq]
+	if bucket == nil {
+		var zero K
+		return zero, false
+	}
+	key := bucket.Back().Value.(*lfuEntry[K]).key
+	l.onRemove(key)
+	return key, true
+}
+
+// 需要知道容量的策略实现这个接口，缓存在创建或切换策略时把分片容量告诉它
+type capacityAware interface {
+	setCapacity(n int)
+}
+
+func newShardAlgo[K comparable](newAlgo func() EvictionAlgo[K], capacity int) EvictionAlgo[K] {
+	e := newAlgo()
+	if c, ok := e.(capacityAware); ok {
+		c.setCapacity(capacity)
+	}
+	return e
+}
+
+// 按最近使用排序的键列表，表头是最近的，ARC、2Q 和 W-TinyLFU 用它组织各自的队列
+type keyList[K comparable] struct {
+	order *list.List
+	items map[K]*list.Element
+}
+
+func newKeyList[K comparable]() *keyList[K] {
+	return &keyList[K]{order: list.New(), items: make(map[K]*list.Element)}
+}
+
+func (l *keyList[K]) len() int {
+	return len(l.items)
+}
+
+func (l *keyList[K]) contains(key K) bool {
+	_, ok := l.items[key]
+	return ok
+}
+
+func (l *keyList[K]) pushFront(key K) {
+	l.items[key] = l.order.PushFront(key)
+}
+
+func (l *keyList[K]) moveToFront(key K) bool {
+	e, ok := l.items[key]
+	if ok {
+		l.order.MoveToFront(e)
+	}
+	return ok
+}
+
+func (l *keyList[K]) remove(key K) bool {
+	e, ok := l.items[key]
+	if ok {
+		l.order.Remove(e)
+		delete(l.items, key)
+	}
+	return ok
+}
+
+func (l *keyList[K]) back() (K, bool) {
+	e := l.order.Back()
+	if e == nil {
+		var zero K
+		return zero, false
+	}
+	return e.Value.(K), true
+}
+
+func (l *keyList[K]) popBack() (K, bool) {
+	key, ok := l.back()
+	if ok {
+		l.remove(key)
+	}
+	return key, ok
+}
+
+// 自适应替换缓存（ARC）：t1 存只访问过一次的键，t2 存访问过多次的键，
+// b1、b2 记住最近从 t1、t2 淘汰的键（只有键没有值）。幽灵命中说明对应的一侧太小，
+// 据此调整 t1 的目标大小 p，扫描只会冲刷 t1，不会挤掉 t2 里的热点键。
+type Arc[K comparable] struct {
+	t1, t2, b1, b2 *keyList[K]
+	p              int // t1 的目标大小
+	capacity       int
+}
+
+func newArc[K comparable]() EvictionAlgo[K] {
+	return &Arc[K]{t1: newKeyList[K](), t2: newKeyList[K](), b1: newKeyList[K](), b2: newKeyList[K]()}
+}
+
+func (a *Arc[K]) name() string {
+	return "arc"
+}
+
+func (a *Arc[K]) setCapacity(n int) {
+	a.capacity = n
+}
+
+func (a *Arc[K]) onAdd(key K) {
+	switch {
+	case a.t1.contains(key) || a.t2.contains(key):
+		a.onAccess(key)
+		return
+	case a.b1.contains(key):
+		a.p = min(a.capacity, a.p+max(a.b2.len()/a.b1.len(), 1))
+		a.b1.remove(key)
+		a.t2.pushFront(key)
+	case a.b2.contains(key):
+		a.p = max(0, a.p-max(a.b1.len()/a.b2.len(), 1))
+		a.b2.remove(key)
+		a.t2.pushFront(key)
+	default:
+		a.t1.pushFront(key)
+	}
+	a.trimGhosts()
+}
+
+// 幽灵列表最多记住 capacity 个键，不限容量时不记
+func (a *Arc[K]) trimGhosts() {
+	for a.b1.len() > 0 && a.t1.len()+a.b1.len() > a.capacity {
+		a.b1.popBack()
+	}
+	for a.b2.len() > 0 && a.t1.len()+a.t2.len()+a.b1.len()+a.b2.len() > 2*a.capacity {
+		a.b2.popBack()
+	}
+}
+
+func (a *Arc[K]) onAccess(key K) {
+	if a.t1.remove(key) {
+		a.t2.pushFront(key)
+		return
+	}
+	a.t2.moveToFront(key)
+}
+
+func (a *Arc[K]) onRemove(key K) {
+	if !a.t1.remove(key) {
+		a.t2.remove(key)
+	}
+}
+
+func (a *Arc[K]) evict() (K, bool) {
+	if a.t1.len() > 0 && (a.t1.len() > a.p || a.t2.len() == 0) {
+		key, _ := a.t1.popBack()
+		a.b1.pushFront(key)
+		return key, true
+	}
+	key, ok := a.t2.popBack()
+	if ok {
+		a.b2.pushFront(key)
+	}
+	return key, ok
+}
+
+func (a *Arc[K]) rebuild(entries []keyMeta[K]) {
+	sortByAccess(entries)
+	a.t1, a.t2, a.b1, a.b2 = newKeyList[K](), newKeyList[K](), newKeyList[K](), newKeyList[K]()
+	a.p = 0
+	for _, e := range entries {
+		if e.hits > 1 {
+			a.t2.pushFront(e.key)
+		} else {
+			a.t1.pushFront(e.key)
+		}
+	}
+}
+
+// 2Q：新键先进入 FIFO 队列 a1in，从 a1in 淘汰的键记在幽灵队列 a1out 里，
+// 再次被访问或在 a1out 里再次出现的键才进入 LRU 队列 am，一次性扫描的键在 a1in 里就被淘汰了。
+type TwoQueue[K comparable] struct {
+	a1in, a1out, am *keyList[K]
+	capacity        int
+}
+
+func newTwoQueue[K comparable]() EvictionAlgo[K] {
+	return &TwoQueue[K]{a1in: newKeyList[K](), a1out: newKeyList[K](), am: newKeyList[K]()}
+}
+
+func (q *TwoQueue[K]) name() string {
+	return "2q"
+}
+
+func (q *TwoQueue[K]) setCapacity(n int) {
+	q.capacity = n
+}
+
+// 论文推荐 a1in 占容量的 1/4，a1out 记住容量一半的键
+func (q *TwoQueue[K]) inLimit() int {
+	return max(q.capacity/4, 1)
+}
+
+func (q *TwoQueue[K]) outLimit() int {
+	return max(q.capacity/2, 1)
+}
+
+func (q *TwoQueue[K]) onAdd(key K) {
+	switch {
+	case q.a1in.contains(key) || q.am.contains(key):
+		q.onAccess(key)
+	case q.a1out.remove(key):
+		q.am.pushFront(key)
+	default:
+		q.a1in.pushFront(key)
+	}
+}
+
+// 论文里 a1in 的命中不改变顺序，但 a1in 在 am 为空时会占满整个缓存，热点键一直在 a1in 里命中，
+// 永远进不了 am，下一次扫描就把它们连同幽灵记录一起冲掉。这里和常见实现一样，a1in 的命中直接升级到 am。
+func (q *TwoQueue[K]) onAccess(key K) {
+	if q.a1in.remove(key) {
+		q.am.pushFront(key)
+		return
+	}
+	q.am.moveToFront(key)
+}
+
+func (q *TwoQueue[K]) onRemove(key K) {
+	if !q.a1in.remove(key) {
+		q.am.remove(key)
+	}
+}
+
+func (q *TwoQueue[K]) evict() (K, bool) {
+	if q.a1in.len() > 0 && (q.a1in.len() > q.inLimit() || q.am.len() == 0) {
+		key, _ := q.a1in.popBack()
+		q.a1out.pushFront(key)
+		for q.a1out.len() > q.outLimit() {
+			q.a1out.popBack()
+		}
+		return key, true
+	}
+	return q.am.popBack()
+}
+
+func (q *TwoQueue[K]) rebuild(entries []keyMeta[K]) {
+	sortByAccess(entries)
+	q.a1in, q.a1out, q.am = newKeyList[K](), newKeyList[K](), newKeyList[K]()
+	for _, e := range entries {
+		if e.hits > 1 {
+			q.am.pushFront(e.key)
+		} else {
+			q.a1in.pushFront(e.key)
+		}
+	}
+}
+
+// 每行 4 位计数器的 count-min sketch，估计键最近的访问频率。
+// 累计记录的次数达到 10 倍宽度时所有计数减半，让过去的热点慢慢冷却。
+type countMinSketch[K comparable] struct {
+	seed    maphash.Seed
+	rows    [4][]uint8
+	mask    uint64
+	samples int
+	resetAt int
+}
+
+func newCountMinSketch[K comparable](capacity int) *countMinSketch[K] {
+	width := 16
+	for width < capacity {
+		width <<= 1
+	}
+	s := &countMinSketch[K]{seed: maphash.MakeSeed(), mask: uint64(width - 1), resetAt: 10 * width}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// 用一个 64 位哈希的两半做双重哈希，得到每行的位置
+func (s *countMinSketch[K]) index(h uint64, row int) uint64 {
+	return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+func (s *countMinSketch[K]) increment(key K) {
+	h := maphash.Comparable(s.seed, key)
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(h, i)]; *c < 15 {
+			*c++
+		}
+	}
+	s.samples++
+	if s.samples >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.samples /= 2
+	}
+}
+
+func (s *countMinSketch[K]) estimate(key K) uint8 {
+	h := maphash.Comparable(s.seed, key)
+	est := uint8(15)
+	for i := range s.rows {
+		est = min(est, s.rows[i][s.index(h, i)])
+	}
+	return est
+}
+
+// W-TinyLFU：新键先进入占容量 1% 的 LRU 窗口，被挤出窗口的键要和主区 probation 段的
+// 淘汰候选比较 sketch 估计的频率，频率更高的留下。主区是分段 LRU，probation 里再次被访问的
+// 键升级到占主区 80% 的 protected 段。
+type WTinyLfu[K comparable] struct {
+	window, probation, protected *keyList[K]
+	sketch                       *countMinSketch[K]
+	capacity                     int
+}
+
+func newWTinyLfu[K comparable]() EvictionAlgo[K] {
+	w := &WTinyLfu[K]{window: newKeyList[K](), probation: newKeyList[K](), protected: newKeyList[K]()}
+	w.setCapacity(0)
+	return w
+}
+
+func (w *WTinyLfu[K]) name() string {
+	return "w-tinylfu"
+}
+
+func (w *WTinyLfu[K]) setCapacity(n int) {
+	w.capacity = n
+	w.sketch = newCountMinSketch[K](n)
+}
+
+func (w *WTinyLfu[K]) windowLimit() int {
+	return max(w.capacity/100, 1)
+}
+
+func (w *WTinyLfu[K]) protectedLimit() int {
+	return (w.capacity - w.windowLimit()) * 4 / 5
+}
+
+func (w *WTinyLfu[K]) onAdd(key K) {
+	if w.window.contains(key) || w.probation.contains(key) || w.protected.contains(key) {
+		w.onAccess(key)
+		return
+	}
+	w.sketch.increment(key)
+	w.window.pushFront(key)
+}
+
+func (w *WTinyLfu[K]) onAccess(key K) {
+	w.sketch.increment(key)
+	switch {
+	case w.window.moveToFront(key), w.protected.moveToFront(key):
+	case w.probation.remove(key):
+		w.protected.pushFront(key)
+		// protected 满了，把最久没访问的降回 probation
+		for w.protected.len() > w.protectedLimit() {
+			demoted, _ := w.protected.popBack()
+			w.probation.pushFront(demoted)
+		}
+	}
+}
+
+func (w *WTinyLfu[K]) onRemove(key K) {
+	_ = w.window.remove(key) || w.probation.remove(key) || w.protected.remove(key)
+}
+
+func (w *WTinyLfu[K]) evict() (K, bool) {
+	for w.window.len() > w.windowLimit() {
+		candidate, _ := w.window.popBack()
+		// 主区还没满，挤出窗口的键直接进入 probation
+		if w.probation.len()+w.protected.len() < w.capacity-w.windowLimit() {
+			w.probation.pushFront(candidate)
+			continue
+		}
+		victim, ok := w.probation.back()
+		if !ok {
+			victim, ok = w.protected.back()
+		}
+		if !ok || w.sketch.estimate(candidate) <= w.sketch.estimate(victim) {
+			return candidate, true
+		}
+		w.onRemove(victim)
+		w.probation.pushFront(candidate)
+		return victim, true
+	}
+	for _, l := range []*keyList[K]{w.probation, w.protected, w.window} {
+		if key, ok := l.popBack(); ok {
+			return key, true
+		}
+	}
+	var zero K
+	return zero, false
+}
+
+func (w *WTinyLfu[K]) rebuild(entries []keyMeta[K]) {
+	sortByAccess(entries)
+	w.window, w.probation, w.protected = newKeyList[K](), newKeyList[K](), newKeyList[K]()
+	w.sketch = newCountMinSketch[K](w.capacity)
+	for i, e := range entries {
+		for range min(e.hits, 15) {
+			w.sketch.increment(e.key)
+		}
+		// 最近访问的几个键留在窗口里，其余的按访问次数分到主区的两段
+		switch {
+		case len(entries)-i <= w.windowLimit():
+			w.window.pushFront(e.key)
+		case e.hits > 1:
+			w.protected.pushFront(e.key)
+		default:
+			w.probation.pushFront(e.key)
+		}
+	}
+	for w.protected.len() > w.protectedLimit() {
+		demoted, _ := w.protected.popBack()
+		w.probation.pushFront(demoted)
+	}
+}
+
+var (
+	errNoLoader       = errors.New("cache has no loader")
+	errLoaderPanicked = errors.New("loader panicked")
+)
+
+// 键被移出缓存的原因，随淘汰回调一起传给使用方
+type EvictReason int
+
+const (
+	EvictedByCapacity EvictReason = iota // 容量已满，被淘汰策略选中
+	EvictedByExpiry                      // TTL 到期
+	EvictedByDelete                      // 调用方主动删除
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictedByCapacity:
+		return "capacity"
+	case EvictedByExpiry:
+		return "expired"
+	case EvictedByDelete:
+		return "deleted"
+	}
+	return fmt.Sprintf("EvictReason(%d)", int(r))
+}
+
+// CacheOptions 的零值可以直接使用：不限容量、16 个分片、条目永不过期
+type CacheOptions[K comparable, V any] struct {
+	Capacity int           // 总容量，平均分给各分片，0 表示不限
+	Shards   int           // 分片数，超过容量时按容量截断，0 表示 16
+	TTL      time.Duration // Add 使用的默认存活时间，0 表示永不过期
+	// 后台清理过期条目的间隔，0 表示只在访问时惰性清理
+	CleanupInterval time.Duration
+	// 条目被淘汰、过期或删除后调用，调用时不持有分片锁，可以安全地访问缓存
+	OnEvict func(key K, value V, reason EvictReason)
+	// 未命中时加载值，同一个键的并发未命中只加载一次
+	Loader func(ctx context.Context, key K) (V, error)
+	// 条目过期后在这段时间内仍返回旧值，同时在后台重新加载，0 表示过期即失效。需要设置 Loader
+	StaleWhileRevalidate time.Duration
+	// 加载失败后在这段时间内直接返回同一个错误，不再调用 Loader，0 表示不缓存错误
+	NegativeTTL time.Duration
+}
+
+type cacheEntry[K comparable, V any] struct {
+	value   V
+	expires time.Time // 零值表示永不过期
+	meta    keyMeta[K]
+}
+
+func (e *cacheEntry[K, V]) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// 过期超过 stale 之后条目才真正失效，之前都可以作为旧值返回
+func (e *cacheEntry[K, V]) dead(now time.Time, stale time.Duration) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires.Add(stale))
+}
+
+// 缓存的加载错误
+type failedLoad struct {
+	err   error
+	until time.Time
 }
 
-type Lfu struct {
+// 一次进行中的加载，同一个键的其他未命中等待 done 关闭后共享结果
+type loadCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+	// 加载期间这个键被 Add 或 Delete 过，加载结果已经过时，不能再写进缓存。由 s.mu 保护
+	superseded bool
 }
 
-func (l *Lfu) evict(c *Cache) {
-	fmt.Println("Evicting by lfu strtegy")
+type evicted[K comparable, V any] struct {
+	key    K
+	value  V
+	reason EvictReason
 }
 
-type Cache struct {
-	storage      map[string]string
-	evictionAlgo EvictionAlgo
-	capacity     int
+// 每个分片有自己的锁、容量和淘汰策略实例，不同分片上的操作互不阻塞
+type cacheShard[K comparable, V any] struct {
+	mu           sync.Mutex
+	storage      map[K]*cacheEntry[K, V]
+	evictionAlgo EvictionAlgo[K]
 	maxCapacity  int
+	clock        uint64
+	failed       map[K]failedLoad
+	calls        map[K]*loadCall[V]
+	// 计数器和条目在同一把锁下更新，热路径上不需要额外的原子操作
+	hits, misses, evictions, expirations uint64
+}
+
+// Cache 按键的哈希把条目分到多个分片上，可以被多个 goroutine 同时使用
+type Cache[K comparable, V any] struct {
+	shards  []*cacheShard[K, V]
+	seed    maphash.Seed
+	ttl     time.Duration
+	onEvict func(K, V, EvictReason)
+	loader  func(context.Context, K) (V, error)
+	stale   time.Duration
+	negTTL  time.Duration
+	stop    chan struct{}
+	closed  sync.Once
+	// 以下统计不属于任何分片
+	capacity      int
+	loadLatency   *histogram
+	loadSuccesses atomic.Uint64
+	loadFailures  atomic.Uint64
+}
+
+// newAlgo 为每个分片创建一个淘汰策略实例
+func newCache[K comparable, V any](newAlgo func() EvictionAlgo[K], opts CacheOptions[K, V]) *Cache[K, V] {
+	n := opts.Shards
+	if n <= 0 {
+		n = 16
+	}
+	if opts.Capacity > 0 {
+		n = min(n, opts.Capacity)
+	}
+	c := &Cache[K, V]{
+		shards:  make([]*cacheShard[K, V], n),
+		seed:    maphash.MakeSeed(),
+		ttl:     opts.TTL,
+		onEvict: opts.OnEvict,
+		loader:  opts.Loader,
+		negTTL:  opts.NegativeTTL,
+		stop:    make(chan struct{}),
+
+		capacity:    opts.Capacity,
+		loadLatency: newHistogram(defaultLatencyBuckets),
+	}
+	for i := range c.shards {
+		capacity := 0
+		if opts.Capacity > 0 {
+			// 除不尽的部分分给前面的分片，总容量正好等于 Capacity
+			capacity = opts.Capacity / n
+			if i < opts.Capacity%n {
+				capacity++
+			}
+		}
+		c.shards[i] = &cacheShard[K, V]{
+			storage:      make(map[K]*cacheEntry[K, V]),
+			failed:       make(map[K]failedLoad),
+			calls:        make(map[K]*loadCall[V]),
+			evictionAlgo: newShardAlgo(newAlgo, capacity),
+			maxCapacity:  capacity,
+		}
+	}
+	if c.loader != nil {
+		c.stale = opts.StaleWhileRevalidate
+	}
+	if opts.CleanupInterval > 0 {
+		go c.cleanupLoop(opts.CleanupInterval)
+	}
+	return c
+}
+
+func (c *Cache[K, V]) shard(key K) *cacheShard[K, V] {
+	return c.shards[maphash.Comparable(c.seed, key)%uint64(len(c.shards))]
+}
+
+// 停止后台清理，缓存本身仍然可以使用
+func (c *Cache[K, V]) Close() {
+	c.closed.Do(func() { close(c.stop) })
+}
+
+func (c *Cache[K, V]) notify(victims []evicted[K, V]) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, v := range victims {
+		c.onEvict(v.key, v.value, v.reason)
+	}
+}
+
+// 切换淘汰策略，新策略的元数据根据缓存里现有的键重建，缓存内容不会丢失。
+// 切换期间持有所有分片的锁，所以对并发的 Get/Add 来说切换是原子的。
+func (c *Cache[K, V]) setEvictionAlgo(newAlgo func() EvictionAlgo[K]) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	for _, s := range c.shards {
+		entries := make([]keyMeta[K], 0, len(s.storage))
+		for _, entry := range s.storage {
+			entries = append(entries, entry.meta)
+		}
+		e := newShardAlgo(newAlgo, s.maxCapacity)
+		e.rebuild(entries)
+		s.evictionAlgo = e
+	}
+}
+
+func (c *Cache[K, V]) Add(key K, value V) {
+	c.AddWithTTL(key, value, c.ttl)
+}
+
+func expiresAfter(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// ttl 为 0 表示永不过期
+func (c *Cache[K, V]) AddWithTTL(key K, value V, ttl time.Duration) {
+	s := c.shard(key)
+	s.mu.Lock()
+	victims := s.add(key, value, expiresAfter(ttl))
+	delete(s.failed, key)
+	s.supersedeLoadLocked(key)
+	s.mu.Unlock()
+	c.notify(victims)
+}
+
+// 返回键对应的值，并更新该键在淘汰策略中的访问信息；已过期的条目在这里被惰性清理。
+// 设置了 Loader 时未命中会加载，加载失败返回 false，需要错误信息时用 Load。
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	if c.loader != nil {
+		value, err := c.Load(context.Background(), key)
+		return value, err == nil
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	value, ok, _, victim := s.get(key, 0)
+	s.mu.Unlock()
+	c.notifyOne(victim)
+	return value, ok
+}
+
+// 返回键对应的值，未命中时调用 Loader 加载并放入缓存。
+// 加载和调用方的 ctx 脱钩：一个调用方放弃等待不会让共享同一次加载的其他调用方失败。
+func (c *Cache[K, V]) Load(ctx context.Context, key K) (V, error) {
+	var zero V
+	if c.loader == nil {
+		return zero, errNoLoader
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	value, ok, stale, victim := s.get(key, c.stale)
+	var call *loadCall[V]
+	switch {
+	case ok:
+		if stale {
+			// 旧值照常返回，后台刷新失败时旧值继续有效，直到彻底失效
+			if _, loading := s.calls[key]; !loading {
+				c.startLoadLocked(s, key, context.Background(), true)
+			}
+		}
+	case s.failed[key].until.After(time.Now()):
+		err := s.failed[key].err
+		s.mu.Unlock()
+		c.notifyOne(victim)
+		return zero, err
+	default:
+		delete(s.failed, key)
+		if call = s.calls[key]; call == nil {
+			call = c.startLoadLocked(s, key, ctx, false)
+		}
+	}
+	s.mu.Unlock()
+	c.notifyOne(victim)
+	if call == nil {
+		return value, nil
+	}
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// 调用方持有 s.mu
+func (c *Cache[K, V]) startLoadLocked(s *cacheShard[K, V], key K, ctx context.Context, refresh bool) *loadCall[V] {
+	call := &loadCall[V]{done: make(chan struct{})}
+	s.calls[key] = call
+	go c.runLoad(s, key, call, context.WithoutCancel(ctx), refresh)
+	return call
+}
+
+// 无论加载成功、失败还是 panic，都会清理 s.calls 并唤醒所有等待者
+func (c *Cache[K, V]) runLoad(s *cacheShard[K, V], key K, call *loadCall[V], ctx context.Context, refresh bool) {
+	start := time.Now()
+	call.value, call.err = c.callLoader(ctx, key)
+	c.recordLoad(time.Since(start), call.err)
+
+	var victims []evicted[K, V]
+	s.mu.Lock()
+	delete(s.calls, key)
+	switch {
+	case call.superseded:
+		// 等待者仍然拿到这次加载的结果，但缓存里保留加载期间写入的值
+	case call.err == nil:
+		victims = s.add(key, call.value, expiresAfter(c.ttl))
+	case !refresh && c.negTTL > 0:
+		s.failed[key] = failedLoad{err: call.err, until: time.Now().Add(c.negTTL)}
+	}
+	s.mu.Unlock()
+	close(call.done)
+	c.notify(victims)
+}
+
+// Loader 的 panic 转换成错误返回给所有等待者，否则 done 永远不会关闭
+func (c *Cache[K, V]) callLoader(ctx context.Context, key K) (value V, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errLoaderPanicked, r)
+		}
+	}()
+	return c.loader(ctx, key)
+}
+
+func (c *Cache[K, V]) notifyOne(victim *evicted[K, V]) {
+	if victim != nil {
+		c.notify([]evicted[K, V]{*victim})
+	}
+}
+
+func (c *Cache[K, V]) Delete(key K) {
+	s := c.shard(key)
+	s.mu.Lock()
+	entry, ok := s.storage[key]
+	if ok {
+		s.remove(key)
+	}
+	delete(s.failed, key)
+	s.supersedeLoadLocked(key)
+	s.mu.Unlock()
+	if ok {
+		c.notify([]evicted[K, V]{{key, entry.value, EvictedByDelete}})
+	}
+}
+
+// 条目数，可能包含还没被清理的过期条目
+func (c *Cache[K, V]) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += len(s.storage)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// 清理所有分片里的过期条目，一次只锁一个分片
+func (c *Cache[K, V]) deleteExpired() {
+	now := time.Now()
+	for _, s := range c.shards {
+		var victims []evicted[K, V]
+		s.mu.Lock()
+		for key, entry := range s.storage {
+			if entry.dead(now, c.stale) {
+				s.remove(key)
+				s.expirations++
+				victims = append(victims, evicted[K, V]{key, entry.value, EvictedByExpiry})
+			}
+		}
+		for key, f := range s.failed {
+			if !f.until.After(now) {
+				delete(s.failed, key)
+			}
+		}
+		s.mu.Unlock()
+		c.notify(victims)
+	}
+}
+
+func (c *Cache[K, V]) cleanupLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.deleteExpired()
+		case <-c.stop:
+			return
+		}
+	}
 }
 
-func initCache(e EvictionAlgo) *Cache {
-	storage := make(map[string]string)
-	return &Cache{
-		storage:      storage,
-		evictionAlgo: e,
-		capacity:     0,
-		maxCapacity:  2,
+func (s *cacheShard[K, V]) add(key K, value V, expires time.Time) []evicted[K, V] {
+	s.clock++
+	if entry, ok := s.storage[key]; ok {
+		entry.value = value
+		entry.expires = expires
+		entry.meta.accessed = s.clock
+		entry.meta.hits++
+		s.evictionAlgo.onAccess(key)
+		return nil
 	}
+	var victims []evicted[K, V]
+	if s.maxCapacity > 0 && len(s.storage) >= s.maxCapacity {
+		if victim, ok := s.evict(); ok {
+			victims = append(victims, victim)
+		}
+	}
+	s.storage[key] = &cacheEntry[K, V]{
+		value:   value,
+		expires: expires,
+		meta:    keyMeta[K]{key: key, inserted: s.clock, accessed: s.clock, hits: 1},
+	}
+	s.evictionAlgo.onAdd(key)
+	return victims
 }
 
-func (c *Cache) setEvictionAlgo(e EvictionAlgo) {
-	c.evictionAlgo = e
+// 查找键，stale 是过期后还能作为旧值返回的时长，返回的第三个值表示命中的是旧值
+func (s *cacheShard[K, V]) get(key K, stale time.Duration) (V, bool, bool, *evicted[K, V]) {
+	var zero V
+	entry, ok := s.storage[key]
+	if !ok {
+		s.misses++
+		return zero, false, false, nil
+	}
+	// 大多数条目不设 TTL，这时不必读取时钟
+	isStale := false
+	if !entry.expires.IsZero() {
+		now := time.Now()
+		if entry.dead(now, stale) {
+			s.remove(key)
+			s.misses++
+			s.expirations++
+			return zero, false, false, &evicted[K, V]{key, entry.value, EvictedByExpiry}
+		}
+		isStale = entry.expired(now)
+	}
+	s.clock++
+	entry.meta.accessed = s.clock
+	entry.meta.hits++
+	s.hits++
+	s.evictionAlgo.onAccess(key)
+	return entry.value, true, isStale, nil
 }
 
-func (c *Cache) add(key, value string) {
-	if c.capacity == c.maxCapacity {
-		c.evict()
+// 调用方持有 s.mu
+func (s *cacheShard[K, V]) supersedeLoadLocked(key K) {
+	if call, ok := s.calls[key]; ok {
+		call.superseded = true
 	}
-	c.capacity++
-	c.storage[key] = value
 }
 
-func (c *Cache) get(key string) {
-	delete(c.storage, key)
+func (s *cacheShard[K, V]) remove(key K) {
+	delete(s.storage, key)
+	s.evictionAlgo.onRemove(key)
 }
 
-func (c *Cache) evict() {
-	c.evictionAlgo.evict(c)
-	c.capacity--
+func (s *cacheShard[K, V]) evict() (evicted[K, V], bool) {
+	key, ok := s.evictionAlgo.evict()
+	if !ok {
+		return evicted[K, V]{}, false
+	}
+	entry := s.storage[key]
+	delete(s.storage, key)
+	reason := EvictedByCapacity
+	if entry.expired(time.Now()) {
+		reason = EvictedByExpiry
+		s.expirations++
+	} else {
+		s.evictions++
+	}
+	return evicted[K, V]{key, entry.value, reason}, true
+}
+
+// 并发未命中合并成一次加载、过期后先返回旧值再后台刷新、加载错误在一段时间内直接返回
+func loadingDemo() error {
+	var loads atomic.Int32
+	errNotFound := errors.New("user not found")
+	cache := newCache(newLru[string], CacheOptions[string, string]{
+		Capacity:             100,
+		TTL:                  30 * time.Millisecond,
+		StaleWhileRevalidate: time.Second,
+		NegativeTTL:          50 * time.Millisecond,
+		Loader: func(ctx context.Context, key string) (string, error) {
+			n := loads.Add(1)
+			time.Sleep(20 * time.Millisecond)
+			switch key {
+			case "nobody":
+				return "", errNotFound
+			case "broken":
+				panic("database driver bug")
+			}
+			return fmt.Sprintf("%s@v%d", key, n), nil
+		},
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Get("alice")
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("50 concurrent misses, %d load\n", loads.Load())
+
+	// 过期后的第一次读取立刻返回旧值，刷新在后台进行
+	time.Sleep(40 * time.Millisecond)
+	start := time.Now()
+	v, _ := cache.Get("alice")
+	fmt.Printf("after expiry: %s in %v\n", v, time.Since(start).Round(10*time.Millisecond))
+	time.Sleep(40 * time.Millisecond)
+	v, _ = cache.Get("alice")
+	fmt.Printf("after refresh: %s\n", v)
+
+	before := loads.Load()
+	_, err1 := cache.Load(context.Background(), "nobody")
+	_, err2 := cache.Load(context.Background(), "nobody")
+	fmt.Printf("negative cache: %v, %v, %d load\n", err1, errors.Is(err2, errNotFound), loads.Load()-before)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := cache.Load(context.Background(), "nobody"); !errors.Is(err, errNotFound) {
+		return fmt.Errorf("unexpected error %v", err)
+	}
+	fmt.Printf("after negative TTL: %d loads\n", loads.Load()-before)
+
+	// 等待的调用方可以单独放弃
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := cache.Load(ctx, "bob"); !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("expected deadline exceeded, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	v, _ = cache.Get("bob")
+	fmt.Printf("abandoned load still cached: %s\n", v)
+
+	// Loader panic 时所有等待者都拿到错误，而不是永远阻塞
+	_, err := cache.Load(context.Background(), "broken")
+	fmt.Printf("panicking loader: %v\n", err)
+
+	// 加载期间直接写入的值比加载结果新，加载结果不会覆盖它
+	loaded := make(chan string)
+	go func() {
+		v, _ := cache.Load(context.Background(), "carol")
+		loaded <- v
+	}()
+	time.Sleep(5 * time.Millisecond)
+	cache.Add("carol", "carol@manual")
+	fmt.Printf("in-flight load returned %s, ", <-loaded)
+	v, _ = cache.Get("carol")
+	fmt.Printf("cache kept %s\n", v)
+	return nil
+}
+
+// Prometheus 默认的延迟分桶，单位秒
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// 固定分桶的延迟直方图，并发记录只用原子操作
+type histogram struct {
+	bounds []float64       // 每个桶的上界，单位秒，升序
+	counts []atomic.Uint64 // 比 bounds 多一个桶，放超过最大上界的值
+	sum    atomic.Int64    // 纳秒
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(h.bounds, d.Seconds())
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{Bounds: h.bounds, Counts: make([]uint64, len(h.counts)), Sum: time.Duration(h.sum.Load())}
+	for i := range h.counts {
+		snap.Counts[i] = h.counts[i].Load()
+		snap.Count += snap.Counts[i]
+	}
+	return snap
+}
+
+type HistogramSnapshot struct {
+	Bounds []float64 // 桶上界，单位秒
+	Counts []uint64  // 每个桶的计数，不累加，最后一个桶是超过最大上界的
+	Count  uint64
+	Sum    time.Duration
+}
+
+// CacheStats 是某一时刻的统计快照，各分片的数字是逐个加锁读取的，彼此之间不保证是同一瞬间
+type CacheStats struct {
+	Hits, Misses  uint64
+	Evictions     uint64 // 因容量被淘汰的条目
+	Expirations   uint64 // 因 TTL 到期被移除的条目
+	LoadSuccesses uint64
+	LoadFailures  uint64
+	LoadLatency   HistogramSnapshot
+	Size          int
+	Capacity      int // 0 表示不限
+}
+
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (c *Cache[K, V]) Stats() CacheStats {
+	stats := CacheStats{
+		LoadSuccesses: c.loadSuccesses.Load(),
+		LoadFailures:  c.loadFailures.Load(),
+		LoadLatency:   c.loadLatency.snapshot(),
+		Capacity:      c.capacity,
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Hits += s.hits
+		stats.Misses += s.misses
+		stats.Evictions += s.evictions
+		stats.Expirations += s.expirations
+		stats.Size += len(s.storage)
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// 旁路缓存的调用方在未命中后自己去数据源加载，用这个方法记录加载的耗时和结果
+func (c *Cache[K, V]) recordLoad(d time.Duration, err error) {
+	c.loadLatency.observe(d)
+	if err != nil {
+		c.loadFailures.Add(1)
+	} else {
+		c.loadSuccesses.Add(1)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 按 Prometheus 文本格式输出统计，name 作为 cache 标签区分同一进程里的多个缓存
+func (s CacheStats) writePrometheus(w io.Writer, name string) error {
+	label := fmt.Sprintf(`cache="%s"`, labelEscaper.Replace(name))
+	var b strings.Builder
+	metric := func(metric, typ, help string, value any) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %v\n", metric, help, metric, typ, metric, label, value)
+	}
+	metric("cache_hits_total", "counter", "Number of cache lookups that found a live entry.", s.Hits)
+	metric("cache_misses_total", "counter", "Number of cache lookups that found no live entry.", s.Misses)
+	metric("cache_evictions_total", "counter", "Number of entries evicted to make room.", s.Evictions)
+	metric("cache_expirations_total", "counter", "Number of entries removed because their TTL passed.", s.Expirations)
+	metric("cache_loads_total", "counter", "Number of successful loads after a miss.", s.LoadSuccesses)
+	metric("cache_load_failures_total", "counter", "Number of failed loads after a miss.", s.LoadFailures)
+	metric("cache_size", "gauge", "Number of entries currently cached.", s.Size)
+	metric("cache_capacity", "gauge", "Maximum number of entries, 0 if unbounded.", s.Capacity)
+
+	const hist = "cache_load_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time spent loading values after a miss.\n# TYPE %s histogram\n", hist, hist)
+	var cumulative uint64
+	for i, bound := range s.LoadLatency.Bounds {
+		cumulative += s.LoadLatency.Counts[i]
+		fmt.Fprintf(&b, "%s_bucket{%s,le=\"%s\"} %d\n", hist, label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(&b, "%s_bucket{%s,le=\"+Inf\"} %d\n", hist, label, s.LoadLatency.Count)
+	fmt.Fprintf(&b, "%s_sum{%s} %g\n", hist, label, s.LoadLatency.Sum.Seconds())
+	fmt.Fprintf(&b, "%s_count{%s} %d\n", hist, label, s.LoadLatency.Count)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// 以 Prometheus 文本格式暴露统计的 HTTP handler，挂到 /metrics 上即可被抓取
+func (c *Cache[K, V]) metricsHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := c.Stats().writePrometheus(w, name); err != nil {
+			log.Printf("write metrics: %v", err)
+		}
+	})
+}
+
+// 模拟一个慢数据源的旁路缓存，然后从本地 HTTP 端点抓取指标
+func statsDemo() error {
+	cache := newCache(newLru[int], CacheOptions[int, string]{Capacity: 4, Shards: 1})
+	backend := func(key int) (string, error) {
+		time.Sleep(time.Duration(key%4) * 3 * time.Millisecond)
+		if key%10 == 9 {
+			return "", fmt.Errorf("backend: key %d not found", key)
+		}
+		return strconv.Itoa(key * key), nil
+	}
+	for i := 0; i < 60; i++ {
+		key := i * i % 13
+		if _, ok := cache.Get(key); ok {
+			continue
+		}
+		start := time.Now()
+		v, err := backend(key)
+		cache.recordLoad(time.Since(start), err)
+		if err == nil {
+			cache.Add(key, v)
+		}
+	}
+	stats := cache.Stats()
+	fmt.Printf("hit ratio %.2f, %d evictions, %d loads (%d failed), size %d/%d\n",
+		stats.HitRatio(), stats.Evictions, stats.LoadSuccesses+stats.LoadFailures, stats.LoadFailures, stats.Size, stats.Capacity)
+
+	server := httptest.NewServer(cache.metricsHandler("squares"))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// 只打印样本行，HELP 和 TYPE 注释省略
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			fmt.Println(line)
+		}
+	}
+	return nil
+}
+
+// 访问日志回放的结果
+type replayResult struct {
+	policy   string
+	hits     int
+	accesses int
+}
+
+func (r replayResult) hitRatio() float64 {
+	if r.accesses == 0 {
+		return 0
+	}
+	return float64(r.hits) / float64(r.accesses)
+}
+
+// 参与比较的所有淘汰策略
+var evictionPolicies = []func() EvictionAlgo[string]{
+	newFifo[string], newLru[string], newLfu[string], newArc[string], newTwoQueue[string], newWTinyLfu[string],
+}
+
+// 把访问日志同时回放给每种策略的缓存：命中计数，未命中就加入缓存，模拟读穿透。
+// 日志每行一次访问，第一个字段是键，其余字段忽略，空行和 # 开头的行跳过。
+func replayTrace(r io.Reader, capacity int, policies ...func() EvictionAlgo[string]) ([]replayResult, error) {
+	caches := make([]*Cache[string, struct{}], len(policies))
+	results := make([]replayResult, len(policies))
+	for i, newAlgo := range policies {
+		// 单分片，保证每种策略看到完整的访问序列
+		caches[i] = newCache(newAlgo, CacheOptions[string, struct{}]{Capacity: capacity, Shards: 1})
+		results[i].policy = newAlgo().name()
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key := fields[0]
+		for i, c := range caches {
+			results[i].accesses++
+			if _, ok := c.Get(key); ok {
+				results[i].hits++
+			} else {
+				c.Add(key, struct{}{})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read trace: %w", err)
+	}
+	return results, nil
+}
+
+func replayTraceFile(path string, capacity int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	results, err := replayTrace(f, capacity, evictionPolicies...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	fmt.Printf("%s, capacity %d\n", path, capacity)
+	for _, r := range results {
+		fmt.Printf("  %-10s hit ratio %6.2f%% (%d/%d)\n", r.policy, 100*r.hitRatio(), r.hits, r.accesses)
+	}
+	return nil
+}
+
+// 生成一份热点键夹杂大范围扫描的访问日志再回放，LRU 会被扫描冲掉，自适应策略能留住热点
+func traceDemo() error {
+	dir, err := os.MkdirTemp("", "trace")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "# 热点键 hot0..hot99，每 1000 次访问夹一次 500 个键的扫描")
+	r := rand.New(rand.NewPCG(1, 2))
+	scan := 0
+	for i := 0; i < 100000; i++ {
+		if i%1000 == 0 {
+			for j := 0; j < 500; j++ {
+				fmt.Fprintf(w, "scan%d\n", scan)
+				scan++
+			}
+		}
+		// 热点键内部也有冷热之分
+		fmt.Fprintf(w, "hot%d\n", int(100*r.Float64()*r.Float64()))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return replayTraceFile(path, 200)
 }
 
 func main() {
-	lfu := &Lfu{}
-	cache := initCache(lfu)
+	trace := flag.String("trace", "", "回放访问日志并报告每种策略的命中率")
+	capacity := flag.Int("capacity", 1000, "回放时的缓存容量")
+	bench := flag.Bool("bench", false, "比较分片缓存和单锁 map 在并发读写下的吞吐量，需要跑几十秒")
+	flag.Parse()
+	if *bench {
+		benchmarkDemo()
+		return
+	}
+	if *trace != "" {
+		if err := replayTraceFile(*trace, *capacity); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	cache.add("a", "1")
-	cache.add("b", "2")
+	cache := newCache(newLfu[string], CacheOptions[string, string]{
+		Capacity: 2,
+		Shards:   1,
+		OnEvict: func(key, value string, reason EvictReason) {
+			fmt.Printf("Evicting %s (%s)\n", key, reason)
+		},
+	})
 
-	cache.add("c", "3")
+	cache.Add("a", "1")
+	cache.Add("b", "2")
+	cache.Get("a")
 
-	lru := &Lru{}
-	cache.setEvictionAlgo(lru)
+	// b 只被访问过一次，被淘汰
+	cache.Add("c", "3")
 
-	cache.add("d", "4")
+	// 切换到 LRU，根据现有的访问记录重建：a 比 c 更早被访问，所以淘汰 a
+	cache.setEvictionAlgo(newLru[string])
+	cache.Add("d", "4")
 
-	fifo := &Fifo{}
-	cache.setEvictionAlgo(fifo)
+	// 切换到 FIFO，c 最早加入，被淘汰
+	cache.setEvictionAlgo(newFifo[string])
+	cache.Add("e", "5")
 
-	cache.add("e", "5")
+	if v, ok := cache.Get("e"); ok {
+		fmt.Printf("e = %s, %d keys cached\n", v, cache.Len())
+	}
 
+	fmt.Println()
+	hotSwapDemo()
+	fmt.Println()
+	ttlDemo()
+	fmt.Println()
+	if err := loadingDemo(); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println()
+	if err := statsDemo(); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println()
+	if err := traceDemo(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// 在并发读写的同时反复切换策略
+func hotSwapDemo() {
+	cache := newCache(newLru[string], CacheOptions[string, string]{Capacity: 16, Shards: 4})
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20000; i++ {
+				key := fmt.Sprintf("k%d", (i*7+n)%16)
+				if _, ok := cache.Get(key); !ok {
+					cache.Add(key, key)
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	swaps := 0
+	algos := evictionPolicies
+	for {
+		select {
+		case <-done:
+			fmt.Printf("Hot swapped strategies %d times under load, %d keys cached\n", swaps, cache.Len())
+			return
+		default:
+			cache.setEvictionAlgo(algos[swaps%len(algos)])
+			swaps++
+		}
+	}
+}
+
+func ttlDemo() {
+	var mu sync.Mutex
+	var expired []string
+	cache := newCache(newLru[string], CacheOptions[string, int]{
+		Capacity:        100,
+		TTL:             50 * time.Millisecond,
+		CleanupInterval: 20 * time.Millisecond,
+		OnEvict: func(key string, value int, reason EvictReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			expired = append(expired, fmt.Sprintf("%s=%d (%s)", key, value, reason))
+		},
+	})
+	defer cache.Close()
+
+	cache.Add("session", 1)
+	cache.AddWithTTL("token", 2, 10*time.Millisecond)
+	cache.AddWithTTL("config", 3, 0)
+
+	time.Sleep(15 * time.Millisecond)
+	// token 已经到期，Get 时被惰性清理
+	_, ok := cache.Get("token")
+	fmt.Printf("token cached after 15ms: %v\n", ok)
+
+	// session 由后台清理
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	fmt.Printf("evicted: %v, %d keys left\n", expired, cache.Len())
+	mu.Unlock()
+}
+
+// 只用一把锁保护的 map，作为分片缓存的对照
+type lockedMap[K comparable, V any] struct {
+	mu sync.Mutex
+	m  map[K]V
+}
+
+func (l *lockedMap[K, V]) Get(key K) (V, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	v, ok := l.m[key]
+	return v, ok
+}
+
+func (l *lockedMap[K, V]) Add(key K, value V) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.m[key] = value
+}
+
+// 90% 读 10% 写，在不同的 goroutine 数量下比较分片缓存和单锁 map
+func benchmarkDemo() {
+	const keys = 1 << 14
+	type store interface {
+		Get(int) (int, bool)
+		Add(int, int)
+	}
+	stores := []struct {
+		name string
+		new  func() store
+	}{
+		{"single-mutex map", func() store { return &lockedMap[int, int]{m: make(map[int]int)} }},
+		{"cache, 1 shard", func() store {
+			return newCache(newLru[int], CacheOptions[int, int]{Capacity: keys, Shards: 1})
+		}},
+		{"cache, 64 shards", func() store {
+			return newCache(newLru[int], CacheOptions[int, int]{Capacity: keys, Shards: 64})
+		}},
+	}
+	// 分片只有在多核上才能减少锁竞争，单核时主要看到的是 LRU 记账和哈希的开销
+	fmt.Printf("GOMAXPROCS=%d\n", runtime.GOMAXPROCS(0))
+	for _, goroutines := range []int{8, 256, 4096} {
+		for _, st := range stores {
+			s := st.new()
+			for i := 0; i < keys; i++ {
+				s.Add(i, i)
+			}
+			result := testing.Benchmark(func(b *testing.B) {
+				// RunParallel 启动 parallelism*GOMAXPROCS 个 goroutine
+				b.SetParallelism(max(goroutines/runtime.GOMAXPROCS(0), 1))
+				b.RunParallel(func(pb *testing.PB) {
+					// 每个 goroutine 从不同的位置开始，避免都挤在同一个分片上
+					i := rand.IntN(keys)
+					for pb.Next() {
+						key := (i * 7919) % keys
+						if i%10 == 0 {
+							s.Add(key, i)
+						} else {
+							s.Get(key)
+						}
+						i++
+					}
+				})
+			})
+			fmt.Printf("%5d goroutines  %-18s %8.1f ns/op\n", goroutines, st.name, float64(result.T.Nanoseconds())/float64(result.N))
+		}
+	}
 }
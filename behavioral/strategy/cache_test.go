@@ -0,0 +1,142 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// 按顺序执行的缓存操作，"+k" 表示 Add，"?k" 表示 Get
+func runOps(t *testing.T, newAlgo func() EvictionAlgo[string], capacity int, ops []string) []string {
+	t.Helper()
+	var victims []string
+	c := newCache(newAlgo, CacheOptions[string, int]{
+		Capacity: capacity,
+		Shards:   1,
+		OnEvict: func(key string, value int, reason EvictReason) {
+			if reason != EvictedByCapacity {
+				t.Errorf("%s evicted by %v, want %v", key, reason, EvictedByCapacity)
+			}
+			victims = append(victims, key)
+		},
+	})
+	defer c.Close()
+	for i, op := range ops {
+		key := op[1:]
+		switch op[0] {
+		case '+':
+			c.Add(key, i)
+		case '?':
+			if _, ok := c.Get(key); !ok {
+				t.Fatalf("Get(%q) missed at step %d", key, i)
+			}
+		default:
+			t.Fatalf("unknown op %q", op)
+		}
+	}
+	if c.Len() > capacity {
+		t.Errorf("Len() = %d, want at most %d", c.Len(), capacity)
+	}
+	return victims
+}
+
+func TestEvictionVictims(t *testing.T) {
+	tests := []struct {
+		name    string
+		newAlgo func() EvictionAlgo[string]
+		ops     []string
+		want    []string
+	}{
+		{
+			name:    "fifo evicts the oldest key",
+			newAlgo: newFifo[string],
+			ops:     []string{"+a", "+b", "+c", "+d"},
+			want:    []string{"a"},
+		},
+		{
+			name:    "fifo ignores Get",
+			newAlgo: newFifo[string],
+			ops:     []string{"+a", "+b", "+c", "?a", "+d", "+e"},
+			want:    []string{"a", "b"},
+		},
+		{
+			name:    "fifo ignores re-Add of an existing key",
+			newAlgo: newFifo[string],
+			ops:     []string{"+a", "+b", "+c", "+a", "+d"},
+			want:    []string{"a"},
+		},
+		{
+			name:    "lru evicts the least recently added key",
+			newAlgo: newLru[string],
+			ops:     []string{"+a", "+b", "+c", "+d"},
+			want:    []string{"a"},
+		},
+		{
+			name:    "lru evicts after a Get",
+			newAlgo: newLru[string],
+			ops:     []string{"+a", "+b", "+c", "?a", "+d", "?c", "+e"},
+			want:    []string{"b", "a"},
+		},
+		{
+			name:    "lfu evicts the least frequently used key",
+			newAlgo: newLfu[string],
+			ops:     []string{"+a", "+b", "+c", "?a", "?a", "?c", "+d"},
+			want:    []string{"b"},
+		},
+		{
+			name:    "lfu evicts after a Get",
+			newAlgo: newLfu[string],
+			ops:     []string{"+a", "+b", "?a", "+c", "+d"},
+			want:    []string{"b"},
+		},
+		{
+			name:    "lfu breaks ties by least recent use",
+			newAlgo: newLfu[string],
+			ops:     []string{"+a", "+b", "+c", "?b", "+d", "+e"},
+			want:    []string{"a", "c"},
+		},
+		{
+			name:    "lfu tie among accessed keys",
+			newAlgo: newLfu[string],
+			ops:     []string{"+a", "+b", "?b", "?a", "+c", "?c", "+d"},
+			want:    []string{"b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runOps(t, tt.newAlgo, 3, tt.ops)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("victims = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 和 main 里的演示相同：切换策略后，新策略根据已有的访问记录选择淘汰对象
+func TestSwitchEvictionAlgo(t *testing.T) {
+	var victims []string
+	c := newCache(newLfu[string], CacheOptions[string, int]{
+		Capacity: 2,
+		Shards:   1,
+		OnEvict: func(key string, value int, reason EvictReason) {
+			victims = append(victims, key)
+		},
+	})
+	defer c.Close()
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")
+	c.Add("c", 3)
+
+	c.setEvictionAlgo(newLru[string])
+	c.Add("d", 4)
+
+	c.setEvictionAlgo(newFifo[string])
+	c.Add("e", 5)
+
+	if want := []string{"b", "a", "c"}; !slices.Equal(victims, want) {
+		t.Errorf("victims = %v, want %v", victims, want)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("evicted key b is still cached")
+	}
+}
@@ -1,47 +1,688 @@
 package main
 
-import "fmt"
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // 策略模式定义一组算法类，将每个算法分别封装起来，让他们可以相互替换，策略模式可以使得算法独立于客户端，策略模式用来解耦策略的定义，创建，使用。
 
+var (
+	errUnknownNode = errors.New("unknown node")
+	errNoRoute     = errors.New("no route")
+)
+
+// 路网里的边类型，不同交通工具能走的边不同
+type EdgeType string
+
+const (
+	Highway  EdgeType = "highway"
+	Road     EdgeType = "road"
+	Cycleway EdgeType = "cycleway"
+	Footpath EdgeType = "footpath"
+	Rail     EdgeType = "rail"
+	Bus      EdgeType = "bus"
+)
+
+type Node struct {
+	ID   string
+	X, Y float64 // 坐标，单位米
+}
+
+type Edge struct {
+	From, To string
+	Type     EdgeType
+	Length   float64 // 单位米
+	Line     string  // 公交、轨道线路名，其他类型为空
+}
+
+// 有向加权图，双向的路在加载时拆成两条边
+type Graph struct {
+	nodes map[string]*Node
+	edges map[string][]Edge
+	// 所有边的长度与端点直线距离之比的最小值，A* 用它把直线距离缩放成不会高估的下界
+	detour float64
+}
+
+// 从文件加载路网，格式见 parseGraph
+func loadGraph(path string) (*Graph, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g, err := parseGraph(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return g, nil
+}
+
+// 每行一条记录，# 开头的是注释：
+//
+//	node <id> <x> <y>
+//	edge <from> <to> <length> <type> [line=<name>] [oneway]
+//
+// 边引用的节点必须先声明，除 oneway 外的边都是双向的。
+func parseGraph(r io.Reader) (*Graph, error) {
+	g := &Graph{nodes: make(map[string]*Node), edges: make(map[string][]Edge), detour: 1}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var err error
+		switch fields[0] {
+		case "node":
+			err = g.parseNode(fields[1:])
+		case "edge":
+			err = g.parseEdge(fields[1:])
+		default:
+			err = fmt.Errorf("unknown record %q", fields[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Graph) parseNode(fields []string) error {
+	if len(fields) != 3 {
+		return errors.New("node needs <id> <x> <y>")
+	}
+	x, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return err
+	}
+	y, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return err
+	}
+	g.nodes[fields[0]] = &Node{ID: fields[0], X: x, Y: y}
+	return nil
+}
+
+func (g *Graph) parseEdge(fields []string) error {
+	if len(fields) < 4 {
+		return errors.New("edge needs <from> <to> <length> <type>")
+	}
+	e := Edge{From: fields[0], To: fields[1], Type: EdgeType(fields[3])}
+	for _, id := range []string{e.From, e.To} {
+		if g.nodes[id] == nil {
+			return fmt.Errorf("%w %q", errUnknownNode, id)
+		}
+	}
+	length, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || length <= 0 {
+		return fmt.Errorf("invalid length %q", fields[2])
+	}
+	e.Length = length
+	oneway := false
+	for _, opt := range fields[4:] {
+		switch {
+		case opt == "oneway":
+			oneway = true
+		case strings.HasPrefix(opt, "line="):
+			e.Line = strings.TrimPrefix(opt, "line=")
+		default:
+			return fmt.Errorf("unknown edge option %q", opt)
+		}
+	}
+	g.addEdge(e)
+	if !oneway {
+		e.From, e.To = e.To, e.From
+		g.addEdge(e)
+	}
+	return nil
+}
+
+func (g *Graph) addEdge(e Edge) {
+	g.edges[e.From] = append(g.edges[e.From], e)
+	if d := g.distance(e.From, e.To); d > 0 {
+		g.detour = min(g.detour, e.Length/d)
+	}
+}
+
+// 两个节点之间的直线距离
+func (g *Graph) distance(from, to string) float64 {
+	a, b := g.nodes[from], g.nodes[to]
+	return math.Hypot(a.X-b.X, a.Y-b.Y)
+}
+
 // 交通工具 策略接口
+// 每种交通工具提供自己的边代价模型，路径规划算法对所有交通工具都一样。
 type Vehicle interface {
-	Go()
+	name() string
+	// 通过边 e 的耗时，prev 是到达 e 起点时走的边，出发时为 nil，用来计算换乘等依赖上一段的代价。
+	// 这种交通工具不能走 e 时返回 false。
+	cost(e Edge, prev *Edge) (time.Duration, bool)
+	// 在任何边上都不会超过的速度，单位米每秒，A* 用它估算剩余耗时的下界
+	maxSpeed() float64
 }
 
-// 具体策略 汽车
+func kmh(v float64) float64 {
+	return v / 3.6
+}
+
+func travelTime(length, speed float64) time.Duration {
+	return time.Duration(length / speed * float64(time.Second))
+}
+
+// 具体策略 汽车：只走公路，高速更快
 type Car struct {
 }
 
-func (r *Car) Go() {
-	fmt.Println("use car")
+func (r *Car) name() string {
+	return "car"
+}
+
+func (r *Car) cost(e Edge, prev *Edge) (time.Duration, bool) {
+	switch e.Type {
+	case Highway:
+		return travelTime(e.Length, kmh(100)), true
+	case Road:
+		return travelTime(e.Length, kmh(40)), true
+	}
+	return 0, false
 }
 
-// 具体策略 自行车
+func (r *Car) maxSpeed() float64 {
+	return kmh(100)
+}
+
+// 具体策略 自行车：不上高速，自行车道比普通道路快
 type Bicycle struct {
 }
 
-func (r *Bicycle) Go() {
-	fmt.Println("use Bicycle")
+func (r *Bicycle) name() string {
+	return "bicycle"
+}
+
+func (r *Bicycle) cost(e Edge, prev *Edge) (time.Duration, bool) {
+	switch e.Type {
+	case Cycleway:
+		return travelTime(e.Length, kmh(18)), true
+	case Road:
+		return travelTime(e.Length, kmh(15)), true
+	}
+	return 0, false
+}
+
+func (r *Bicycle) maxSpeed() float64 {
+	return kmh(18)
+}
+
+// 具体策略 步行：除高速和轨道外都能走
+type Walking struct {
+}
+
+func (r *Walking) name() string {
+	return "walking"
+}
+
+func (r *Walking) cost(e Edge, prev *Edge) (time.Duration, bool) {
+	switch e.Type {
+	case Road, Cycleway, Footpath:
+		return travelTime(e.Length, kmh(5)), true
+	}
+	return 0, false
+}
+
+func (r *Walking) maxSpeed() float64 {
+	return kmh(5)
+}
+
+// 具体策略 公共交通：乘坐轨道和公交，站点之间步行。
+// 上车要等车，换乘到另一条线路还要再加换乘时间。
+type Transit struct {
+	Wait     time.Duration // 上车前的平均候车时间
+	Transfer time.Duration // 换乘额外花费的时间，不含候车
+}
+
+func (r *Transit) name() string {
+	return "transit"
+}
+
+func (r *Transit) cost(e Edge, prev *Edge) (time.Duration, bool) {
+	var ride time.Duration
+	switch e.Type {
+	case Rail:
+		ride = travelTime(e.Length, kmh(60))
+	case Bus:
+		ride = travelTime(e.Length, kmh(25))
+	default:
+		return (&Walking{}).cost(e, prev)
+	}
+	switch {
+	case prev == nil || prev.Line == "":
+		ride += r.Wait
+	case prev.Line != e.Line:
+		ride += r.Wait + r.Transfer
+	}
+	return ride, true
+}
+
+func (r *Transit) maxSpeed() float64 {
+	return kmh(60)
+}
+
+// 规划出的路线，Steps 按行进顺序排列
+type Route struct {
+	Vehicle  string
+	Steps    []Edge
+	Distance float64 // 单位米
+	ETA      time.Duration
+}
+
+func (r Route) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %.1f km, %v", r.Vehicle, r.Distance/1000, r.ETA.Round(time.Minute))
+	for i, s := range r.Steps {
+		if i == 0 {
+			fmt.Fprintf(&b, "\n  %s", s.From)
+		}
+		via := string(s.Type)
+		if s.Line != "" {
+			via += " " + s.Line
+		}
+		fmt.Fprintf(&b, " -(%s)-> %s", via, s.To)
+	}
+	return b.String()
+}
+
+// 搜索状态：所在节点加上到达时所在的线路。公交的代价依赖上一段所在的线路，
+// 同一节点从不同线路到达要当作不同状态，否则先到的状态会挡住之后换乘更少的路线。
+type searchState struct {
+	node string
+	line string
+}
+
+type searchItem struct {
+	state    searchState
+	elapsed  time.Duration
+	priority time.Duration // elapsed 加上剩余耗时的下界
+	distance float64
+	via      *Edge
+	parent   *searchItem
+}
+
+type searchQueue []*searchItem
+
+func (q searchQueue) Len() int           { return len(q) }
+func (q searchQueue) Less(i, j int) bool { return q[i].priority < q[j].priority }
+func (q searchQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *searchQueue) Push(x any) {
+	*q = append(*q, x.(*searchItem))
+}
+func (q *searchQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// 用 A* 找耗时最短的路线。启发函数是直线距离按路网最小绕行比缩放后除以最高速度，
+// 不会高估剩余耗时，所以结果和 Dijkstra 一样是最优的，只是展开的节点更少。
+func planRoute(g *Graph, v Vehicle, from, to string) (Route, error) {
+	for _, id := range []string{from, to} {
+		if g.nodes[id] == nil {
+			return Route{}, fmt.Errorf("%w %q", errUnknownNode, id)
+		}
+	}
+	heuristic := func(node string) time.Duration {
+		return travelTime(g.distance(node, to)*g.detour, v.maxSpeed())
+	}
+	start := &searchItem{state: searchState{node: from}, priority: heuristic(from)}
+	best := map[searchState]time.Duration{start.state: 0}
+	queue := &searchQueue{start}
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(*searchItem)
+		if item.elapsed > best[item.state] {
+			continue // 已经有更快的方式到达这个状态
+		}
+		if item.state.node == to {
+			return buildRoute(v, item), nil
+		}
+		for i := range g.edges[item.state.node] {
+			e := &g.edges[item.state.node][i]
+			cost, ok := v.cost(*e, item.via)
+			if !ok {
+				continue
+			}
+			next := searchState{node: e.To, line: e.Line}
+			elapsed := item.elapsed + cost
+			if b, seen := best[next]; seen && b <= elapsed {
+				continue
+			}
+			best[next] = elapsed
+			heap.Push(queue, &searchItem{
+				state:    next,
+				elapsed:  elapsed,
+				priority: elapsed + heuristic(e.To),
+				distance: item.distance + e.Length,
+				via:      e,
+				parent:   item,
+			})
+		}
+	}
+	return Route{}, fmt.Errorf("%w from %s to %s by %s", errNoRoute, from, to, v.name())
+}
+
+func buildRoute(v Vehicle, last *searchItem) Route {
+	route := Route{Vehicle: v.name(), Distance: last.distance, ETA: last.elapsed}
+	for item := last; item.via != nil; item = item.parent {
+		route.Steps = append(route.Steps, *item.via)
+	}
+	for i, j := 0, len(route.Steps)-1; i < j; i, j = i+1, j-1 {
+		route.Steps[i], route.Steps[j] = route.Steps[j], route.Steps[i]
+	}
+	return route
+}
+
+var errUnknownVehicle = errors.New("unknown vehicle")
+
+// 一次出行请求，选择器根据这些信息决定用哪种交通工具
+type TripRequest struct {
+	UserID   string
+	From, To string
+	Raining  bool
+	Tier     string // 用户等级，例如 free、premium
+}
+
+// 按请求选择交通工具的策略，返回的说明会记进日志，用来区分这次选择的来源
+type VehicleSelector interface {
+	selectVehicle(req TripRequest, distance float64) (Vehicle, string)
+}
+
+// 一条选择规则，条件的零值表示不限。规则可以从 JSON 配置加载。
+type Rule struct {
+	Name        string   `json:"name"`
+	MinDistance float64  `json:"min_distance,omitempty"` // 起终点直线距离，单位米
+	MaxDistance float64  `json:"max_distance,omitempty"`
+	Raining     *bool    `json:"raining,omitempty"`
+	Tiers       []string `json:"tiers,omitempty"`
+	Vehicle     string   `json:"vehicle"`
+}
+
+func (r Rule) matches(req TripRequest, distance float64) bool {
+	return distance >= r.MinDistance &&
+		(r.MaxDistance == 0 || distance < r.MaxDistance) &&
+		(r.Raining == nil || *r.Raining == req.Raining) &&
+		(len(r.Tiers) == 0 || slices.Contains(r.Tiers, req.Tier))
+}
+
+// 按顺序匹配规则，第一条命中的规则生效，都不命中时用 fallback
+type ruleSelector struct {
+	rules    []Rule
+	vehicles map[string]Vehicle
+	fallback Vehicle
+}
+
+func newRuleSelector(vehicles map[string]Vehicle, rules []Rule, fallback string) (*ruleSelector, error) {
+	for _, r := range rules {
+		if vehicles[r.Vehicle] == nil {
+			return nil, fmt.Errorf("rule %q: %w %q", r.Name, errUnknownVehicle, r.Vehicle)
+		}
+	}
+	if vehicles[fallback] == nil {
+		return nil, fmt.Errorf("fallback: %w %q", errUnknownVehicle, fallback)
+	}
+	return &ruleSelector{rules: rules, vehicles: vehicles, fallback: vehicles[fallback]}, nil
+}
+
+func parseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("parse rules: %w", err)
+	}
+	return rules, nil
+}
+
+func (s *ruleSelector) selectVehicle(req TripRequest, distance float64) (Vehicle, string) {
+	for _, r := range s.rules {
+		if r.matches(req, distance) {
+			return s.vehicles[r.Vehicle], "rule " + r.Name
+		}
+	}
+	return s.fallback, "fallback"
+}
+
+// A/B 实验的一组，Weight 是相对权重
+type Arm struct {
+	Vehicle string
+	Weight  int
+}
+
+// 按权重把用户分到各组。分组只取决于实验名和用户 ID 的哈希，同一个用户每次都分到同一组，
+// 换一个实验名就会重新打散。
+type abSelector struct {
+	experiment string
+	arms       []Arm
+	total      int
+	vehicles   map[string]Vehicle
+}
+
+func newABSelector(vehicles map[string]Vehicle, experiment string, arms ...Arm) (*abSelector, error) {
+	s := &abSelector{experiment: experiment, arms: arms, vehicles: vehicles}
+	for _, a := range arms {
+		if vehicles[a.Vehicle] == nil {
+			return nil, fmt.Errorf("experiment %q: %w %q", experiment, errUnknownVehicle, a.Vehicle)
+		}
+		if a.Weight < 0 {
+			return nil, fmt.Errorf("experiment %q: negative weight for %s", experiment, a.Vehicle)
+		}
+		s.total += a.Weight
+	}
+	if s.total == 0 {
+		return nil, fmt.Errorf("experiment %q has no weighted arms", experiment)
+	}
+	return s, nil
+}
+
+func (s *abSelector) selectVehicle(req TripRequest, distance float64) (Vehicle, string) {
+	h := fnv.New64a()
+	io.WriteString(h, s.experiment)
+	h.Write([]byte{0})
+	io.WriteString(h, req.UserID)
+	bucket := int(h.Sum64() % uint64(s.total))
+	for _, a := range s.arms {
+		if bucket < a.Weight {
+			return s.vehicles[a.Vehicle], fmt.Sprintf("experiment %s arm %s", s.experiment, a.Vehicle)
+		}
+		bucket -= a.Weight
+	}
+	panic("unreachable: bucket exceeds total weight")
+}
+
+func vehicleRegistry(vs ...Vehicle) map[string]Vehicle {
+	m := make(map[string]Vehicle, len(vs))
+	for _, v := range vs {
+		m[v.name()] = v
+	}
+	return m
 }
 
 // 上下文 旅行者
 type Traveler struct {
-	impl Vehicle
+	impl     Vehicle
+	graph    *Graph
+	selector VehicleSelector
+	log      *slog.Logger
 }
 
 func (r *Traveler) SetVehicle(i Vehicle) {
 	r.impl = i
 }
 
-func (r *Traveler) Go() {
-	r.impl.Go()
+func (r *Traveler) SetSelector(s VehicleSelector) {
+	r.selector = s
+}
+
+func (r *Traveler) Go(from, to string) (Route, error) {
+	return planRoute(r.graph, r.impl, from, to)
+}
+
+// 由选择器为这次请求挑选交通工具并规划路线，不改变 SetVehicle 设置的交通工具，可以并发调用。
+// 每次选择和结果都记一条日志，方便按交通工具和选择来源对比效果。
+func (r *Traveler) Plan(req TripRequest) (Route, error) {
+	if r.selector == nil {
+		return Route{}, errors.New("traveler has no selector")
+	}
+	for _, id := range []string{req.From, req.To} {
+		if r.graph.nodes[id] == nil {
+			return Route{}, fmt.Errorf("%w %q", errUnknownNode, id)
+		}
+	}
+	distance := r.graph.distance(req.From, req.To)
+	v, reason := r.selector.selectVehicle(req, distance)
+	route, err := planRoute(r.graph, v, req.From, req.To)
+	attrs := []any{
+		"user", req.UserID, "from", req.From, "to", req.To,
+		"vehicle", v.name(), "selected_by", reason,
+	}
+	if err != nil {
+		r.logger().Warn("vehicle selected", append(attrs, "error", err)...)
+		return Route{}, err
+	}
+	r.logger().Info("vehicle selected", append(attrs, "distance_m", route.Distance, "eta", route.ETA.Round(time.Second))...)
+	return route, nil
 }
 
+func (r *Traveler) logger() *slog.Logger {
+	if r.log == nil {
+		return slog.Default()
+	}
+	return r.log
+}
+
+// 一个小城市：高速绕城，市中心有自行车道和步行街，两条轨道线在 Center 换乘
+const cityGraph = `
+node Home      0    0
+node Park    800  300
+node School 1500    0
+node Center 3000  500
+node Mall   4200 1800
+node Airport 9000 4000
+node Station 5200  600
+
+edge Home   Park    900  footpath
+edge Park   School  800  cycleway
+edge Home   School 1600  road
+edge School Center 1700  road
+edge Park   Center 2400  cycleway
+edge Center Mall   1900  road
+edge Center Station 2300 road
+edge Home   Airport 11000 highway
+edge Station Airport 4800 highway
+edge Home   Center 3200  rail line=L1
+edge Center Station 2200 rail line=L1
+edge Center Mall   1800  bus line=B7
+edge Station Airport 4500 rail line=L2
+`
+
 func main() {
-	traveler := Traveler{}
-	traveler.SetVehicle(&Car{})
-	traveler.Go()
-	traveler.SetVehicle(&Bicycle{})
-	traveler.Go()
+	dir, err := os.MkdirTemp("", "graph")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "city.graph")
+	if err := os.WriteFile(path, []byte(cityGraph), 0o644); err != nil {
+		fmt.Println(err)
+		return
+	}
+	graph, err := loadGraph(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	traveler := Traveler{graph: graph}
+	for _, v := range []Vehicle{&Car{}, &Bicycle{}, &Walking{}, &Transit{Wait: 4 * time.Minute, Transfer: 3 * time.Minute}} {
+		traveler.SetVehicle(v)
+		for _, to := range []string{"Mall", "Airport"} {
+			route, err := traveler.Go("Home", to)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println(route)
+		}
+	}
+
+	fmt.Println()
+	if err := selectorDemo(graph); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// 下雨或会员长途打车，近距离步行，其余骑车；另一组用户参加自行车和公交的 A/B 实验
+const selectionRules = `[
+	{"name": "rain", "raining": true, "min_distance": 1000, "vehicle": "car"},
+	{"name": "premium-long", "tiers": ["premium"], "min_distance": 4000, "vehicle": "car"},
+	{"name": "short", "max_distance": 1500, "vehicle": "walking"},
+	{"name": "long", "min_distance": 6000, "vehicle": "transit"}
+]`
+
+func selectorDemo(graph *Graph) error {
+	vehicles := vehicleRegistry(&Car{}, &Bicycle{}, &Walking{}, &Transit{Wait: 4 * time.Minute, Transfer: 3 * time.Minute})
+	rules, err := parseRules(strings.NewReader(selectionRules))
+	if err != nil {
+		return err
+	}
+	byRules, err := newRuleSelector(vehicles, rules, "bicycle")
+	if err != nil {
+		return err
+	}
+	// 日志去掉时间，输出稳定，便于对照
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	traveler := Traveler{graph: graph, selector: byRules, log: logger}
+	for _, req := range []TripRequest{
+		{UserID: "u1", From: "Home", To: "Park"},
+		{UserID: "u2", From: "Home", To: "Mall", Raining: true},
+		{UserID: "u3", From: "Home", To: "Mall", Tier: "premium"},
+		{UserID: "u4", From: "Home", To: "Center"},
+		{UserID: "u5", From: "Home", To: "Airport"},
+	} {
+		traveler.Plan(req)
+	}
+
+	ab, err := newABSelector(vehicles, "commute-2026", Arm{"bicycle", 1}, Arm{"transit", 1})
+	if err != nil {
+		return err
+	}
+	traveler.SetSelector(ab)
+	// 同一个用户两次请求分到同一组
+	for _, user := range []string{"u1", "u2", "u3", "u1", "u2", "u3"} {
+		traveler.Plan(TripRequest{UserID: user, From: "Home", To: "Center"})
+	}
+	return nil
 }
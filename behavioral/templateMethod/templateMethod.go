@@ -1,6 +1,19 @@
 package main
 
-import "fmt"
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
 
 // 模板方法模式是一种行为设计模式， 它在超类中定义了一个算法的框架， 允许子类在不修改结构的情况下重写算法的特定步骤。
 
@@ -9,89 +22,763 @@ import "fmt"
 // 2、在缓存中保存这组数字以便进行后续验证。
 // 3、准备内容。
 // 4、发送通知。
+// 用户收到后提交验证码，再按同样的方式：
+// 5、校验验证码。
 
 // 后续引入的任何新 OTP 类型都很有可能需要进行相同的上述步骤。
 // 因此， 我们会有这样的一个场景， 其中某个特定操作的步骤是相同的， 但实现方式却可能有所不同。 这正是适合考虑使用模板方法模式的情况。
 // 首先， 我们定义一个由固定数量的方法组成的基础模板算法。 这就是我们的模板方法。 然后我们将实现每一个步骤方法， 但不会改变模板方法。
 type IOtp interface {
-	genRandomOTP(int) string
-	saveOTPCache(string)
+	genRandomOTP(recipient string, length int) (string, error)
+	saveOTPCache(recipient, otp string)
 	getMessage(string) string
-	sendNotification(string) error
+	sendNotification(recipient, message string) error
+	verifyOTPCache(recipient, otp string) error
 }
 
+var (
+	errInvalidLength   = errors.New("invalid otp length")
+	errOTPNotFound     = errors.New("no otp issued")
+	errOTPExpired      = errors.New("otp expired")
+	errOTPMismatch     = errors.New("otp mismatch")
+	errTooManyAttempts = errors.New("too many attempts")
+	errInvalidConfig   = errors.New("invalid authenticator config")
+)
+
 type Otp struct {
 	iOtp IOtp
+	// 发送和校验的频率限制，所有渠道共用同一套规则，为空时不限制
+	guard *otpGuard
 }
 
-func (o *Otp) genAndSendOTP(otpLength int) error {
-	otp := o.iOtp.genRandomOTP(otpLength)
-	o.iOtp.saveOTPCache(otp)
-	message := o.iOtp.getMessage(otp)
-	err := o.iOtp.sendNotification(message)
+// ip 是请求方的地址，用于按 IP 限流
+func (o *Otp) genAndSendOTP(recipient, ip string, otpLength int) error {
+	if o.guard != nil {
+		if err := o.guard.allowSend(recipient, ip); err != nil {
+			return err
+		}
+	}
+	otp, err := o.iOtp.genRandomOTP(recipient, otpLength)
+	if err == nil {
+		o.iOtp.saveOTPCache(recipient, otp)
+		message := o.iOtp.getMessage(otp)
+		err = o.iOtp.sendNotification(recipient, message)
+	}
 	if err != nil {
+		// 没发出去不算，用户可以马上重试；次数限制照常计入，防止用失败的请求绕过限流
+		if o.guard != nil {
+			o.guard.resetCooldown(recipient)
+		}
+		return err
+	}
+	return nil
+}
+
+// 用户手动输入的验证码常带空格，统一去掉后再交给具体的校验步骤
+func (o *Otp) verifyOTP(recipient, ip, otp string) error {
+	if o.guard != nil {
+		if err := o.guard.allowVerify(recipient, ip); err != nil {
+			return err
+		}
+	}
+	err := o.iOtp.verifyOTPCache(recipient, strings.ReplaceAll(strings.TrimSpace(otp), " ", ""))
+	if o.guard != nil {
+		o.guard.recordVerify(recipient, err)
+	}
+	return err
+}
+
+var (
+	errRateLimited = errors.New("rate limited")
+	errCoolingDown = errors.New("resend cooling down")
+	errLockedOut   = errors.New("locked out")
+)
+
+// 被限制时返回，RetryAfter 是最早可以重试的等待时间
+type LimitError struct {
+	Err        error
+	Scope      string // 触发限制的对象，例如收件人或 IP
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v for %s, retry after %v", e.Err, e.Scope, e.RetryAfter.Round(time.Second))
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// 窗口内最多 Limit 次，Limit 为 0 表示不限
+type rateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+type otpLimits struct {
+	PerRecipient rateLimit     // 每个收件人的发送次数
+	PerIP        rateLimit     // 每个 IP 的发送次数，校验次数单独按同样的限制计算
+	Cooldown     time.Duration // 同一个收件人两次发送之间的最短间隔
+	// 连续校验失败 MaxFailures 次后锁定收件人 Lockout 时长，期间既不能发送也不能校验。
+	// 单个验证码的尝试次数由各渠道的存储限制，锁定防止用户不断重发新验证码来继续猜。
+	MaxFailures int
+	Lockout     time.Duration
+}
+
+var defaultOTPLimits = otpLimits{
+	PerRecipient: rateLimit{Limit: 5, Window: time.Hour},
+	PerIP:        rateLimit{Limit: 20, Window: time.Hour},
+	Cooldown:     time.Minute,
+	MaxFailures:  5,
+	Lockout:      15 * time.Minute,
+}
+
+// 每隔这么久顺带清理一次不再起作用的记录，否则只来过一次的收件人和 IP 会一直留在内存里
+const otpPruneInterval = time.Minute
+
+// 按滑动窗口记录每个键最近的请求时间，窗口外的记录在下次检查时丢弃
+type otpGuard struct {
+	mu        sync.Mutex
+	limits    otpLimits
+	now       func() time.Time
+	requests  map[string][]time.Time
+	lastSent  map[string]time.Time
+	failures  map[string]failureCount
+	locked    map[string]time.Time // 收件人 -> 锁定到期时间
+	lastPrune time.Time
+}
+
+// 连续校验失败的次数和最后一次失败的时间
+type failureCount struct {
+	count int
+	last  time.Time
+}
+
+func newOTPGuard(limits otpLimits) *otpGuard {
+	return &otpGuard{
+		limits:   limits,
+		now:      time.Now,
+		requests: make(map[string][]time.Time),
+		lastSent: make(map[string]time.Time),
+		failures: make(map[string]failureCount),
+		locked:   make(map[string]time.Time),
+	}
+}
+
+// 连续失败的计数在最后一次失败之后这么久没有新的失败就清零
+func (g *otpGuard) failureTTL() time.Duration {
+	return max(g.limits.PerRecipient.Window, g.limits.Lockout)
+}
+
+// 调用方持有 g.mu。距离上次清理超过 otpPruneInterval 时删掉已经不影响任何判断的记录
+func (g *otpGuard) pruneLocked(now time.Time) {
+	if now.Sub(g.lastPrune) < otpPruneInterval {
+		return
+	}
+	g.lastPrune = now
+	window := max(g.limits.PerRecipient.Window, g.limits.PerIP.Window)
+	for key, times := range g.requests {
+		if len(times) == 0 || !times[len(times)-1].After(now.Add(-window)) {
+			delete(g.requests, key)
+		}
+	}
+	for recipient, last := range g.lastSent {
+		if !now.Before(last.Add(g.limits.Cooldown)) {
+			delete(g.lastSent, recipient)
+		}
+	}
+	for recipient, f := range g.failures {
+		if !now.Before(f.last.Add(g.failureTTL())) {
+			delete(g.failures, recipient)
+		}
+	}
+	for recipient, until := range g.locked {
+		if !now.Before(until) {
+			delete(g.locked, recipient)
+		}
+	}
+}
+
+// 检查所有限制，全部通过才记录这次发送，被拒绝的请求不占用次数
+func (g *otpGuard) allowSend(recipient, ip string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	g.pruneLocked(now)
+	if err := g.checkLockout(recipient, now); err != nil {
+		return err
+	}
+	if last, ok := g.lastSent[recipient]; ok && g.limits.Cooldown > 0 {
+		if wait := last.Add(g.limits.Cooldown).Sub(now); wait > 0 {
+			return &LimitError{Err: errCoolingDown, Scope: recipient, RetryAfter: wait}
+		}
+	}
+	recipientKey, ipKey := "send recipient "+recipient, "send ip "+ip
+	if err := g.checkRate(recipientKey, recipient, g.limits.PerRecipient, now); err != nil {
+		return err
+	}
+	if err := g.checkRate(ipKey, ip, g.limits.PerIP, now); err != nil {
+		return err
+	}
+	g.record(recipientKey, g.limits.PerRecipient, now)
+	g.record(ipKey, g.limits.PerIP, now)
+	g.lastSent[recipient] = now
+	return nil
+}
+
+func (g *otpGuard) resetCooldown(recipient string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.lastSent, recipient)
+}
+
+func (g *otpGuard) allowVerify(recipient, ip string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	g.pruneLocked(now)
+	if err := g.checkLockout(recipient, now); err != nil {
+		return err
+	}
+	key := "verify ip " + ip
+	if err := g.checkRate(key, ip, g.limits.PerIP, now); err != nil {
 		return err
 	}
+	g.record(key, g.limits.PerIP, now)
+	return nil
+}
+
+// 只有猜错了一个确实发出过、仍然有效的验证码才算失败。没有发过验证码或者验证码已过期时不计数，
+// 否则任何人都能用一个从未申请过验证码的号码把它锁住
+func (g *otpGuard) recordVerify(recipient string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err == nil {
+		delete(g.failures, recipient)
+		return
+	}
+	if !errors.Is(err, errOTPMismatch) && !errors.Is(err, errTooManyAttempts) {
+		return
+	}
+	now := g.now()
+	f := g.failures[recipient]
+	if now.Sub(f.last) >= g.failureTTL() {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+	g.failures[recipient] = f
+	if g.limits.MaxFailures > 0 && f.count >= g.limits.MaxFailures {
+		delete(g.failures, recipient)
+		g.locked[recipient] = now.Add(g.limits.Lockout)
+	}
+}
+
+// 调用方持有 g.mu
+func (g *otpGuard) checkLockout(recipient string, now time.Time) error {
+	until, ok := g.locked[recipient]
+	if !ok {
+		return nil
+	}
+	if now.Before(until) {
+		return &LimitError{Err: errLockedOut, Scope: recipient, RetryAfter: until.Sub(now)}
+	}
+	delete(g.locked, recipient)
+	return nil
+}
+
+// 调用方持有 g.mu
+func (g *otpGuard) checkRate(key, scope string, limit rateLimit, now time.Time) error {
+	if limit.Limit <= 0 {
+		return nil
+	}
+	times := g.requests[key]
+	i := 0
+	for i < len(times) && !times[i].After(now.Add(-limit.Window)) {
+		i++
+	}
+	times = times[i:]
+	if len(times) == 0 {
+		delete(g.requests, key)
+	} else {
+		g.requests[key] = times
+	}
+	if len(times) >= limit.Limit {
+		return &LimitError{Err: errRateLimited, Scope: scope, RetryAfter: times[0].Add(limit.Window).Sub(now)}
+	}
 	return nil
 }
 
+// 调用方持有 g.mu，并且刚用 checkRate 检查过同一个键
+func (g *otpGuard) record(key string, limit rateLimit, now time.Time) {
+	if limit.Limit > 0 {
+		g.requests[key] = append(g.requests[key], now)
+	}
+}
+
+// 用 crypto/rand 生成 length 位十进制数字，每一位都均匀分布，保留前导零
+func randomDigits(length int) (string, error) {
+	if length < 1 || length > 18 {
+		return "", fmt.Errorf("%w: %d", errInvalidLength, length)
+	}
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", length, n), nil
+}
+
+// 保存已发出的验证码。只存摘要，验证成功、过期或失败次数用完后作废，
+// 同一个收件人重新发送会覆盖之前的验证码并重置次数。
+type otpStore struct {
+	mu          sync.Mutex
+	entries     map[string]*storedOTP
+	ttl         time.Duration
+	maxAttempts int
+	now         func() time.Time
+	lastPrune   time.Time
+}
+
+type storedOTP struct {
+	digest   [sha256.Size]byte
+	expires  time.Time
+	attempts int
+}
+
+func newOTPStore(ttl time.Duration, maxAttempts int) *otpStore {
+	return &otpStore{
+		entries:     make(map[string]*storedOTP),
+		ttl:         ttl,
+		maxAttempts: maxAttempts,
+		now:         time.Now,
+	}
+}
+
+func (s *otpStore) save(recipient, otp string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	// 发出后没人来校验的验证码不会在 verify 里被删掉，定期清理过期的
+	if now.Sub(s.lastPrune) >= otpPruneInterval {
+		s.lastPrune = now
+		for r, entry := range s.entries {
+			if !now.Before(entry.expires) {
+				delete(s.entries, r)
+			}
+		}
+	}
+	s.entries[recipient] = &storedOTP{digest: sha256.Sum256([]byte(otp)), expires: now.Add(s.ttl)}
+}
+
+func (s *otpStore) verify(recipient, otp string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[recipient]
+	if !ok {
+		return errOTPNotFound
+	}
+	if !s.now().Before(entry.expires) {
+		delete(s.entries, recipient)
+		return errOTPExpired
+	}
+	digest := sha256.Sum256([]byte(otp))
+	if subtle.ConstantTimeCompare(digest[:], entry.digest[:]) == 1 {
+		delete(s.entries, recipient)
+		return nil
+	}
+	entry.attempts++
+	if entry.attempts >= s.maxAttempts {
+		delete(s.entries, recipient)
+		return errTooManyAttempts
+	}
+	return fmt.Errorf("%w, %d attempts left", errOTPMismatch, s.maxAttempts-entry.attempts)
+}
+
+// RFC 4226 HOTP：对 8 字节大端计数器做 HMAC-SHA1，动态截断出 31 位整数后取低 digits 位十进制
+func hotp(secret []byte, counter uint64, digits int) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for range digits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// RFC 6238 TOTP：计数器是从 Unix 纪元开始经过的 step 个数
+func totp(secret []byte, t time.Time, step time.Duration, digits int) string {
+	return hotp(secret, totpCounter(t, step), digits)
+}
+
+func totpCounter(t time.Time, step time.Duration) uint64 {
+	return uint64(t.Unix() / int64(step/time.Second))
+}
+
 type Sms struct {
 	Otp
+	store *otpStore
+	// 真正发出消息的网关，为空时只打印
+	send func(recipient, message string) error
 }
 
-func (s *Sms) genRandomOTP(len int) string {
-	randomOTP := "1234"
-	fmt.Printf("SMS: generating random otp %s\n", randomOTP)
-	return randomOTP
+func (s *Sms) genRandomOTP(recipient string, length int) (string, error) {
+	randomOTP, err := randomDigits(length)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("SMS: generating random otp for %s\n", recipient)
+	return randomOTP, nil
 }
 
-func (s *Sms) saveOTPCache(otp string) {
-	fmt.Printf("SMS: saving otp: %s to cache\n", otp)
+func (s *Sms) saveOTPCache(recipient, otp string) {
+	fmt.Printf("SMS: saving otp for %s to cache\n", recipient)
+	s.store.save(recipient, otp)
 }
 
 func (s *Sms) getMessage(otp string) string {
 	return "SMS OTP for login is " + otp
 }
 
-func (s *Sms) sendNotification(message string) error {
-	fmt.Printf("SMS: sending sms: %s\n", message)
+func (s *Sms) sendNotification(recipient, message string) error {
+	fmt.Printf("SMS: sending sms to %s: %s\n", recipient, message)
+	if s.send != nil {
+		return s.send(recipient, message)
+	}
 	return nil
 }
 
+func (s *Sms) verifyOTPCache(recipient, otp string) error {
+	return s.store.verify(recipient, otp)
+}
+
 type Email struct {
 	Otp
+	store *otpStore
+	// 真正发出消息的网关，为空时只打印
+	send func(recipient, message string) error
 }
 
-func (s *Email) genRandomOTP(len int) string {
-	randomOTP := "1234"
-	fmt.Printf("EMAIL: generating random otp %s\n", randomOTP)
-	return randomOTP
+func (s *Email) genRandomOTP(recipient string, length int) (string, error) {
+	randomOTP, err := randomDigits(length)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("EMAIL: generating random otp for %s\n", recipient)
+	return randomOTP, nil
 }
 
-func (s *Email) saveOTPCache(otp string) {
-	fmt.Printf("EMAIL: saving otp: %s to cache\n", otp)
+func (s *Email) saveOTPCache(recipient, otp string) {
+	fmt.Printf("EMAIL: saving otp for %s to cache\n", recipient)
+	s.store.save(recipient, otp)
 }
 
 func (s *Email) getMessage(otp string) string {
 	return "EMAIL OTP for login is " + otp
 }
 
-func (s *Email) sendNotification(message string) error {
-	fmt.Printf("EMAIL: sending email: %s\n", message)
+func (s *Email) sendNotification(recipient, message string) error {
+	fmt.Printf("EMAIL: sending email to %s: %s\n", recipient, message)
+	if s.send != nil {
+		return s.send(recipient, message)
+	}
 	return nil
 }
 
+func (s *Email) verifyOTPCache(recipient, otp string) error {
+	return s.store.verify(recipient, otp)
+}
+
+// 身份验证器 App：验证码由用户设备根据共享密钥自己算出，服务端不生成、不保存、不发送验证码，
+// 只提醒用户打开 App，校验时用同一个密钥重新计算。
+// TimeBased 为 true 时是 TOTP，允许前后 Skew 个时间步的时钟偏差；否则是 HOTP，
+// 允许用户设备的计数器最多超前 LookAhead 次（RFC 4226 第 7.4 节的重新同步）。
+// 两种模式下用过的计数器都不能再用，防止验证码被重放。
+type Authenticator struct {
+	Otp
+	TimeBased bool
+	Step      time.Duration
+	Skew      uint64
+	LookAhead uint64
+	Digits    int
+	now       func() time.Time
+
+	mu       sync.Mutex
+	accounts map[string]*authenticatorAccount
+}
+
+type authenticatorAccount struct {
+	secret []byte
+	next   uint64 // 下一个可以接受的计数器
+}
+
+func newAuthenticator(timeBased bool) *Authenticator {
+	return &Authenticator{
+		TimeBased: timeBased,
+		Step:      30 * time.Second,
+		Skew:      1,
+		LookAhead: 10,
+		Digits:    6,
+		now:       time.Now,
+		accounts:  make(map[string]*authenticatorAccount),
+	}
+}
+
+// 字段是导出的，可能在创建后被改掉，所以每次使用前检查。
+// Step 不足一秒或不是整秒时 totpCounter 会除以零或算错；Digits 超过 9 时 hotp 的模数溢出 uint32，RFC 4226 要求至少 6 位
+func (a *Authenticator) validate() error {
+	if a.TimeBased && (a.Step < time.Second || a.Step%time.Second != 0) {
+		return fmt.Errorf("%w: step %v must be a whole number of seconds", errInvalidConfig, a.Step)
+	}
+	if a.Digits < 6 || a.Digits > 8 {
+		return fmt.Errorf("%w: digits %d must be between 6 and 8", errInvalidConfig, a.Digits)
+	}
+	return nil
+}
+
+// 为用户生成共享密钥，返回值交给用户的 App（通常通过二维码）
+func (a *Authenticator) enroll(recipient string) ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accounts[recipient] = &authenticatorAccount{secret: secret}
+	return secret, nil
+}
+
+// 验证码在用户设备上生成，这里没有需要发出去的内容
+func (a *Authenticator) genRandomOTP(recipient string, length int) (string, error) {
+	if err := a.validate(); err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.accounts[recipient] == nil {
+		return "", fmt.Errorf("%w: %s has not enrolled", errOTPNotFound, recipient)
+	}
+	return "", nil
+}
+
+func (a *Authenticator) saveOTPCache(recipient, otp string) {
+}
+
+func (a *Authenticator) getMessage(otp string) string {
+	return "Enter the code shown in your authenticator app"
+}
+
+func (a *Authenticator) sendNotification(recipient, message string) error {
+	fmt.Printf("AUTHENTICATOR: prompting %s: %s\n", recipient, message)
+	return nil
+}
+
+func (a *Authenticator) verifyOTPCache(recipient, otp string) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	account, ok := a.accounts[recipient]
+	if !ok {
+		return errOTPNotFound
+	}
+	from, to := account.next, account.next+a.LookAhead
+	if a.TimeBased {
+		now := totpCounter(a.now(), a.Step)
+		from, to = max(now-min(now, a.Skew), account.next), now+a.Skew
+	}
+	for counter := from; counter <= to; counter++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(account.secret, counter, a.Digits)), []byte(otp)) == 1 {
+			account.next = counter + 1
+			return nil
+		}
+	}
+	return errOTPMismatch
+}
+
+// 演示用的网关，记下每个收件人最后收到的验证码，代替用户去读短信和邮件
+type outbox struct {
+	codes map[string]string
+}
+
+func (b *outbox) send(recipient, message string) error {
+	b.codes[recipient] = message[strings.LastIndex(message, " ")+1:]
+	return nil
+}
+
+// 演示请求都来自同一个地址
+const clientIP = "203.0.113.7"
+
 func main() {
-	smsOTP := &Sms{}
+	box := &outbox{codes: make(map[string]string)}
+	guard := newOTPGuard(defaultOTPLimits)
+	smsOTP := &Sms{store: newOTPStore(5*time.Minute, 3), send: box.send}
 	o := Otp{
-		iOtp: smsOTP,
+		iOtp:  smsOTP,
+		guard: guard,
 	}
-	o.genAndSendOTP(4)
+	phone := "+8613800000000"
+	if err := o.genAndSendOTP(phone, clientIP, 6); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println("verify wrong code:", o.verifyOTP(phone, clientIP, "not-it"))
+	fmt.Println("verify right code:", o.verifyOTP(phone, clientIP, box.codes[phone]))
+	fmt.Println("verify again:", o.verifyOTP(phone, clientIP, box.codes[phone]))
 
 	fmt.Println("")
-	emailOTP := &Email{}
+	emailOTP := &Email{store: newOTPStore(5*time.Minute, 3), send: box.send}
 	o = Otp{
-		iOtp: emailOTP,
+		iOtp:  emailOTP,
+		guard: guard,
+	}
+	mail := "alice@example.com"
+	// 发送失败不触发冷却，紧接着可以重发
+	fmt.Println("invalid length:", o.genAndSendOTP(mail, clientIP, 0))
+	if err := o.genAndSendOTP(mail, clientIP, 8); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println("resend at once:", o.genAndSendOTP(mail, clientIP, 8))
+	// 用户输入时带了空格
+	code := box.codes[mail]
+	fmt.Println("verify right code:", o.verifyOTP(mail, clientIP, code[:4]+" "+code[4:]))
+
+	fmt.Println("")
+	storeDemo()
+	fmt.Println("")
+	limitsDemo()
+	fmt.Println("")
+	if err := authenticatorDemo(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// 过期和尝试次数限制，用可控的时钟代替等待
+func storeDemo() {
+	now := time.Now()
+	store := newOTPStore(5*time.Minute, 3)
+	store.now = func() time.Time { return now }
+
+	store.save("bob", "123456")
+	for range 3 {
+		fmt.Println("guess:", store.verify("bob", "000000"))
+	}
+	fmt.Println("right code after lockout:", store.verify("bob", "123456"))
+
+	store.save("bob", "123456")
+	now = now.Add(5 * time.Minute)
+	fmt.Println("right code after 5 minutes:", store.verify("bob", "123456"))
+}
+
+// 用可控的时钟演示限流、冷却和锁定，短信和邮件共用同一个 guard
+func limitsDemo() {
+	now := time.Now()
+	guard := newOTPGuard(otpLimits{
+		PerRecipient: rateLimit{Limit: 3, Window: time.Hour},
+		PerIP:        rateLimit{Limit: 4, Window: time.Hour},
+		Cooldown:     time.Minute,
+		MaxFailures:  3,
+		Lockout:      15 * time.Minute,
+	})
+	guard.now = func() time.Time { return now }
+	quiet := func(recipient, message string) error { return nil }
+	smsStore, emailStore := newOTPStore(5*time.Minute, 10), newOTPStore(5*time.Minute, 10)
+	smsStore.now = func() time.Time { return now }
+	emailStore.now = smsStore.now
+	sms := Otp{iOtp: &Sms{store: smsStore, send: quiet}, guard: guard}
+	email := Otp{iOtp: &Email{store: emailStore, send: quiet}, guard: guard}
+
+	for i := 0; i < 4; i++ {
+		err := sms.genAndSendOTP("+8613911111111", clientIP, 6)
+		fmt.Printf("sms #%d after %v: %v\n", i+1, time.Duration(i)*2*time.Minute, err)
+		now = now.Add(2 * time.Minute)
+	}
+	// 换一个收件人，同一个 IP 的第 4 次还能发，第 5 次超限
+	for _, mail := range []string{"bob@example.com", "carol@example.com"} {
+		fmt.Printf("email to %s: %v\n", mail, email.genAndSendOTP(mail, clientIP, 6))
+	}
+
+	// 没有申请过验证码的号码，猜多少次都不会被锁定，否则谁都能把别人的号码锁住
+	bystander := "+8613933333333"
+	for i := 0; i < 3; i++ {
+		sms.verifyOTP(bystander, "198.51.100.1", "000000")
+	}
+	fmt.Println("send to bystander:", sms.genAndSendOTP(bystander, "198.51.100.2", 6))
+
+	// 对发出过的验证码连续猜错 3 次后锁定，锁定期间正确的验证码也不接受，其他 IP 也一样
+	victim := "+8613922222222"
+	if err := sms.genAndSendOTP(victim, "198.51.100.2", 6); err != nil {
+		fmt.Println(err)
+	}
+	for i := 0; i < 3; i++ {
+		sms.verifyOTP(victim, "198.51.100.3", "000000")
+	}
+	now = now.Add(time.Minute)
+	fmt.Println("send while locked:", sms.genAndSendOTP(victim, "198.51.100.2", 6))
+	fmt.Println("verify while locked:", email.verifyOTP(victim, "198.51.100.2", "000000"))
+	now = now.Add(15 * time.Minute)
+	fmt.Println("send after lockout:", sms.genAndSendOTP(victim, "198.51.100.2", 6))
+
+	// 所有窗口都过去之后，下一次请求会顺带清掉不再起作用的记录
+	now = now.Add(2 * time.Hour)
+	fmt.Println("verify after 2 hours:", sms.verifyOTP(victim, "198.51.100.2", "000000"))
+	guard.mu.Lock()
+	fmt.Printf("after 2 hours: %d rate keys, %d cooldowns, %d failure counts, %d lockouts\n",
+		len(guard.requests), len(guard.lastSent), len(guard.failures), len(guard.locked))
+	guard.mu.Unlock()
+}
+
+func authenticatorDemo() error {
+	// RFC 4226 附录 D 和 RFC 6238 附录 B 的测试向量
+	secret := []byte("12345678901234567890")
+	for counter, want := range []string{"755224", "287082", "359152"} {
+		if got := hotp(secret, uint64(counter), 6); got != want {
+			return fmt.Errorf("hotp(%d) = %s, want %s", counter, got, want)
+		}
+	}
+	for unix, want := range map[int64]string{59: "94287082", 1111111109: "07081804", 2000000000: "69279037"} {
+		if got := totp(secret, time.Unix(unix, 0), 30*time.Second, 8); got != want {
+			return fmt.Errorf("totp(%d) = %s, want %s", unix, got, want)
+		}
 	}
-	o.genAndSendOTP(4)
+	fmt.Println("RFC 4226 and RFC 6238 test vectors pass")
+
+	now := time.Unix(1700000000, 0)
+	auth := newAuthenticator(true)
+	auth.now = func() time.Time { return now }
+	o := Otp{iOtp: auth}
+	key, err := auth.enroll("carol")
+	if err != nil {
+		return err
+	}
+	if err := o.genAndSendOTP("carol", clientIP, 6); err != nil {
+		return err
+	}
+	// 用户设备的时钟慢了 20 秒
+	code := totp(key, now.Add(-20*time.Second), auth.Step, auth.Digits)
+	fmt.Println("totp from a slow device:", o.verifyOTP("carol", clientIP, code))
+	fmt.Println("totp replayed:", o.verifyOTP("carol", clientIP, code))
+	fmt.Println("unenrolled:", o.genAndSendOTP("dave", clientIP, 6))
+
+	counterAuth := newAuthenticator(false)
+	o = Otp{iOtp: counterAuth}
+	key, err = counterAuth.enroll("erin")
+	if err != nil {
+		return err
+	}
+	// 用户在设备上多按了 3 次，计数器超前
+	fmt.Println("hotp ahead by 3:", o.verifyOTP("erin", clientIP, hotp(key, 3, 6)))
+	fmt.Println("hotp older counter:", o.verifyOTP("erin", clientIP, hotp(key, 2, 6)))
+	fmt.Println("hotp next counter:", o.verifyOTP("erin", clientIP, hotp(key, 4, 6)))
+
+	// 配置错误时拒绝使用，而不是除以零或者算出溢出的验证码
+	counterAuth.Digits = 10
+	fmt.Println("misconfigured digits:", o.verifyOTP("erin", clientIP, hotp(key, 5, 6)))
+	auth.Step = 500 * time.Millisecond
+	o = Otp{iOtp: auth}
+	fmt.Println("misconfigured step:", o.genAndSendOTP("carol", clientIP, 6))
+	return nil
 }